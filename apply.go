@@ -0,0 +1,252 @@
+package mysql_flashback
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+// UPDATE/DELETE影响的行数不为1时的处理方式
+const (
+	ApplyStop = "stop" // 回滚当前事务并停止执行
+	ApplySkip = "skip" // 回滚当前事务, 继续执行之后的事务, 执行完后返回错误
+)
+
+// 报告中每条sql的状态
+const (
+	StatusApplied = "APPLIED"
+	StatusSkipped = "SKIPPED"
+	StatusFailed  = "FAILED"
+)
+
+// 执行结果, 按sql计数
+type ApplyResult struct {
+	Applied int
+	Skipped int
+	Failed  int
+}
+
+func (r *ApplyResult) String() string {
+	return fmt.Sprintf("applied: %d, skipped: %d, failed: %d", r.Applied, r.Skipped, r.Failed)
+}
+
+// 按事务执行回滚文件中的sql. 文件中BEGIN/COMMIT之间的sql在一个事务中执行, 不在事务中的sql各自为一个事务
+type Applier struct {
+	db         *sql.DB
+	onMismatch string
+	report     io.Writer // 为nil则不输出报告
+	result     ApplyResult
+	rolledBack int // 因出错或影响行数不符被回滚的事务数
+}
+
+// dsn格式同Config.MysqlUri. UPDATE的影响行数按匹配的行计算(clientFoundRows), 值没有变化时也为1.
+// 会话的时区为UTC, 与回滚sql中TIMESTAMP的值一致
+func NewApplier(dsn string, onMismatch string, report io.Writer) (*Applier, error) {
+	switch onMismatch {
+	case "":
+		onMismatch = ApplyStop
+	case ApplyStop, ApplySkip:
+	default:
+		return nil, fmt.Errorf("apply mismatch policy is illegal: %s", onMismatch)
+	}
+
+	cfg, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg.ClientFoundRows = true
+	setUTCTimeZone(cfg)
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	return &Applier{db: db, onMismatch: onMismatch, report: report}, nil
+}
+
+func (a *Applier) Close() error {
+	return a.db.Close()
+}
+
+func (a *Applier) Result() ApplyResult {
+	return a.result
+}
+
+type applyStmt struct {
+	sql    string
+	status string
+	reason string
+}
+
+// 执行file中的sql, 注释行会被忽略, DDL不会执行(记为SKIPPED). 遇到被注释的不完整事务时返回错误.
+// 出错或影响行数不符时, stop立即返回错误, skip执行完所有事务后返回错误. 已经提交的事务不会撤销
+func (a *Applier) ApplyFile(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	var tx []*applyStmt
+	inTx := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<30)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case line == SqlTimeZone:
+			// 连接已经设置了时区
+		case strings.HasPrefix(line, SqlIncompleteBegin):
+			return fmt.Errorf("%w: %s: %s", ErrApplyFailed, txIncomplete, line)
+		case strings.HasPrefix(line, "BEGIN;"):
+			inTx = true
+		case line == "COMMIT;":
+			if err := a.applyTx(ctx, tx); err != nil {
+				return errors.Trace(err)
+			}
+			tx, inTx = tx[:0], false
+		case strings.HasPrefix(line, "/*"), strings.HasPrefix(line, SqlComment):
+		default:
+			stmt, ok := parseApplyStmt(line)
+			if !ok {
+				a.record(&applyStmt{sql: line, status: StatusSkipped, reason: "ddl is not applied"})
+				continue
+			}
+			if !inTx {
+				if err := a.applyTx(ctx, []*applyStmt{stmt}); err != nil {
+					return errors.Trace(err)
+				}
+				continue
+			}
+			tx = append(tx, stmt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	// 文件在事务中间结束(如解析被中断), 不完整的事务不执行
+	for _, stmt := range tx {
+		stmt.status, stmt.reason = StatusSkipped, txIncomplete
+		a.record(stmt)
+	}
+	if a.rolledBack != 0 {
+		return fmt.Errorf("%w: %d transactions rolled back, %s", ErrApplyFailed, a.rolledBack, &a.result)
+	}
+	return nil
+}
+
+// ROW行为 sql; /* ROW -> ... */, 去掉注释和末尾的分号
+func parseApplyStmt(line string) (*applyStmt, bool) {
+	idx := strings.LastIndex(line, " /* ROW -> ")
+	if idx == -1 {
+		return nil, false
+	}
+	return &applyStmt{sql: strings.TrimSuffix(line[:idx], ";")}, true
+}
+
+func (a *Applier) applyTx(ctx context.Context, stmts []*applyStmt) (err error) {
+	if len(stmts) == 0 {
+		return nil
+	}
+	defer func() {
+		for _, stmt := range stmts {
+			a.record(stmt)
+		}
+	}()
+
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		markStmts(stmts, StatusFailed, err.Error())
+		return errors.Trace(err)
+	}
+	for idx, stmt := range stmts {
+		reason, err := a.exec(ctx, tx, stmt)
+		if reason == "" && err == nil {
+			continue
+		}
+		tx.Rollback()
+		a.rolledBack++
+		markStmts(stmts, StatusSkipped, "transaction rolled back")
+		stmt.status, stmt.reason = StatusFailed, reason
+		if err != nil {
+			stmt.reason = err.Error()
+		}
+		if a.onMismatch == ApplySkip && err == nil {
+			stmt.status = StatusSkipped
+		}
+		if ctx.Err() != nil {
+			return errors.Trace(ctx.Err())
+		}
+		if a.onMismatch == ApplyStop {
+			for _, rest := range stmts[idx+1:] {
+				rest.reason = "not executed"
+			}
+			return fmt.Errorf("%w: %s: %s", ErrApplyFailed, stmt.reason, stmt.sql)
+		}
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		markStmts(stmts, StatusFailed, err.Error())
+		return errors.Trace(err)
+	}
+	markStmts(stmts, StatusApplied, "")
+	return nil
+}
+
+// 返回影响行数不符的原因
+func (a *Applier) exec(ctx context.Context, tx *sql.Tx, stmt *applyStmt) (string, error) {
+	res, err := tx.ExecContext(ctx, stmt.sql)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if strings.HasPrefix(stmt.sql, "INSERT") {
+		return "", nil
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if affected != 1 {
+		return fmt.Sprintf("rows affected: %d, expected 1", affected), nil
+	}
+	return "", nil
+}
+
+func markStmts(stmts []*applyStmt, status, reason string) {
+	for _, stmt := range stmts {
+		stmt.status, stmt.reason = status, reason
+	}
+}
+
+func (a *Applier) record(stmt *applyStmt) {
+	switch stmt.status {
+	case StatusApplied:
+		a.result.Applied++
+	case StatusSkipped:
+		a.result.Skipped++
+	default:
+		a.result.Failed++
+	}
+	if stmt.status != StatusApplied {
+		log.Warnf("%s %s: %s", stmt.status, stmt.reason, stmt.sql)
+	}
+	if a.report == nil {
+		return
+	}
+	if stmt.reason == "" {
+		fmt.Fprintf(a.report, "%s | %s\n", stmt.status, stmt.sql)
+	} else {
+		fmt.Fprintf(a.report, "%s | %s | %s\n", stmt.status, stmt.reason, stmt.sql)
+	}
+}
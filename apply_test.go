@@ -0,0 +1,190 @@
+package mysql_flashback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/server"
+)
+
+// 记录执行的sql, 按affected返回影响行数(默认为1), failed中的sql返回错误
+type testApplyServer struct {
+	server.EmptyHandler
+	affected map[string]uint64
+	failed   map[string]bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *testApplyServer) UseDB(string) error {
+	return nil
+}
+
+func (s *testApplyServer) HandleQuery(query string) (*gomysql.Result, error) {
+	if strings.HasPrefix(query, "SET ") {
+		return &gomysql.Result{}, nil
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+	if s.failed[query] {
+		return nil, gomysql.NewError(gomysql.ER_DUP_ENTRY, "Duplicate entry")
+	}
+	affected, ok := s.affected[query]
+	if !ok {
+		affected = 1
+	}
+	return &gomysql.Result{AffectedRows: affected}, nil
+}
+
+const (
+	testApplyDelete = "DELETE FROM `shop`.`t` WHERE `id`=1 LIMIT 1"
+	testApplyUpdate = "UPDATE `shop`.`t` SET `name`='a' WHERE `id`=2 LIMIT 1"
+	testApplyInsert = "INSERT INTO `shop`.`t`(`id`,`name`) VALUES (3,'c')"
+)
+
+func testApplyRow(sql string) string {
+	return sql + "; /* ROW -> binlog: mysql-bin.000001 | pos: (4, 120) | time: 2023-11-14 22:13:20 */"
+}
+
+func TestApplierApplyFile(t *testing.T) {
+	// 两个事务: DELETE+UPDATE, INSERT
+	file := strings.Join([]string{
+		SqlTimeZone,
+		"BEGIN; /* ROLLBACK -> 2 | binlog: mysql-bin.000001 | pos: (4, 300) | time: 2023-11-14 22:13:20 */",
+		testApplyRow(testApplyDelete),
+		testApplyRow(testApplyUpdate),
+		"COMMIT;",
+		"",
+		"BEGIN; /* ROLLBACK -> 1 | binlog: mysql-bin.000001 | pos: (300, 500) | time: 2023-11-14 22:13:20 */",
+		testApplyRow(testApplyInsert),
+		"COMMIT;",
+	}, "\n")
+
+	tests := []struct {
+		name        string
+		content     string
+		onMismatch  string
+		affected    map[string]uint64
+		failed      map[string]bool
+		wantErr     bool
+		wantResult  ApplyResult
+		wantQueries []string
+		wantReport  []string // 报告中每行的状态
+	}{
+		{
+			name:        "applied",
+			content:     file,
+			wantResult:  ApplyResult{Applied: 3},
+			wantQueries: []string{"START TRANSACTION", testApplyDelete, testApplyUpdate, "COMMIT", "START TRANSACTION", testApplyInsert, "COMMIT"},
+			wantReport:  []string{StatusApplied, StatusApplied, StatusApplied},
+		},
+		{
+			name:        "mismatch stop",
+			content:     file,
+			onMismatch:  ApplyStop,
+			affected:    map[string]uint64{testApplyDelete: 0},
+			wantErr:     true,
+			wantResult:  ApplyResult{Skipped: 1, Failed: 1},
+			wantQueries: []string{"START TRANSACTION", testApplyDelete, "ROLLBACK"},
+			wantReport:  []string{StatusFailed, StatusSkipped},
+		},
+		{
+			name:        "mismatch skip",
+			content:     file,
+			onMismatch:  ApplySkip,
+			affected:    map[string]uint64{testApplyUpdate: 2},
+			wantErr:     true,
+			wantResult:  ApplyResult{Applied: 1, Skipped: 2},
+			wantQueries: []string{"START TRANSACTION", testApplyDelete, testApplyUpdate, "ROLLBACK", "START TRANSACTION", testApplyInsert, "COMMIT"},
+			wantReport:  []string{StatusSkipped, StatusSkipped, StatusApplied},
+		},
+		{
+			name:        "error skip",
+			content:     file,
+			onMismatch:  ApplySkip,
+			failed:      map[string]bool{testApplyInsert: true},
+			wantErr:     true,
+			wantResult:  ApplyResult{Applied: 2, Failed: 1},
+			wantQueries: []string{"START TRANSACTION", testApplyDelete, testApplyUpdate, "COMMIT", "START TRANSACTION", testApplyInsert, "ROLLBACK"},
+			wantReport:  []string{StatusApplied, StatusApplied, StatusFailed},
+		},
+		{
+			name: "outside transaction and ddl",
+			content: strings.Join([]string{
+				"/* DDL -> binlog: mysql-bin.000001 | pos: (4, 120) */",
+				"ALTER TABLE `shop`.`t` ADD COLUMN `c` int;",
+				testApplyRow(testApplyDelete),
+				testApplyRow(testApplyInsert),
+			}, "\n"),
+			wantResult:  ApplyResult{Applied: 2, Skipped: 1},
+			wantQueries: []string{"START TRANSACTION", testApplyDelete, "COMMIT", "START TRANSACTION", testApplyInsert, "COMMIT"},
+			wantReport:  []string{StatusSkipped, StatusApplied, StatusApplied},
+		},
+		{
+			name: "incomplete transaction",
+			content: strings.Join([]string{
+				SqlTimeZone,
+				SqlComment + "BEGIN; /* ROLLBACK -> 3 | incomplete transaction | binlog: mysql-bin.000001 | pos: (500, 600) | time: 2023-11-14 22:13:20 */",
+				SqlComment + testApplyRow(testApplyDelete),
+				SqlComment + "COMMIT;",
+				"BEGIN; /* ROLLBACK -> 1 | binlog: mysql-bin.000001 | pos: (300, 500) | time: 2023-11-14 22:13:20 */",
+				testApplyRow(testApplyInsert),
+				"COMMIT;",
+			}, "\n"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testApplyServer{affected: tt.affected, failed: tt.failed}
+			dsn := listenTestServer(t, s)
+			file := filepath.Join(t.TempDir(), "rollback.sql")
+			if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			report := &bytes.Buffer{}
+			applier, err := NewApplier(dsn, tt.onMismatch, report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer applier.Close()
+
+			err = applier.ApplyFile(context.Background(), file)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("ApplyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrApplyFailed) {
+				t.Errorf("ApplyFile() error = %v, want %v", err, ErrApplyFailed)
+			}
+			if got := applier.Result(); got != tt.wantResult {
+				t.Errorf("Result() = %s, want %s", &got, &tt.wantResult)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !reflect.DeepEqual(s.queries, tt.wantQueries) {
+				t.Errorf("queries = %q, want %q", s.queries, tt.wantQueries)
+			}
+			var statuses []string
+			for _, line := range strings.Split(report.String(), "\n") {
+				if line != "" {
+					statuses = append(statuses, strings.SplitN(line, " | ", 2)[0])
+				}
+			}
+			if !reflect.DeepEqual(statuses, tt.wantReport) {
+				t.Errorf("report = %q, want statuses %q", report.String(), tt.wantReport)
+			}
+		})
+	}
+}
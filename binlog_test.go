@@ -0,0 +1,199 @@
+package mysql_flashback
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/google/uuid"
+)
+
+var testServerUUID = uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+
+const testBinlogTime = 1700000000
+
+// 测试用: 按binlog格式生成event(不带checksum).
+// 表为 testSchemaDump 中的 shop.t, shop.u: (id int primary key, name varchar(20))
+type testBinlog struct {
+	events [][]byte
+	pos    uint32
+	time   uint32 // 之后添加的event的时间
+}
+
+func newTestBinlog() *testBinlog {
+	b := &testBinlog{pos: 4, time: testBinlogTime}
+	body := binary.LittleEndian.AppendUint16(nil, 4)
+	version := make([]byte, 50)
+	copy(version, "5.7.30-log")
+	body = append(body, version...)
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = append(body, replication.EventHeaderSize)
+	// 每种event的post header长度
+	postHeader := make([]byte, 40)
+	postHeader[replication.QUERY_EVENT-1] = 13
+	postHeader[replication.ROTATE_EVENT-1] = 8
+	postHeader[replication.TABLE_MAP_EVENT-1] = 8
+	postHeader[replication.WRITE_ROWS_EVENTv2-1] = 10
+	postHeader[replication.UPDATE_ROWS_EVENTv2-1] = 10
+	postHeader[replication.DELETE_ROWS_EVENTv2-1] = 10
+	postHeader[replication.GTID_EVENT-1] = 42
+	postHeader[replication.ANONYMOUS_GTID_EVENT-1] = 42
+	body = append(body, postHeader...)
+	body = append(body, 0, 0, 0, 0, 0)
+	b.add(replication.FORMAT_DESCRIPTION_EVENT, body)
+	return b
+}
+
+func (b *testBinlog) add(typ replication.EventType, body []byte) {
+	size := uint32(replication.EventHeaderSize + len(body))
+	b.pos += size
+	header := binary.LittleEndian.AppendUint32(nil, b.time)
+	header = append(header, byte(typ))
+	header = binary.LittleEndian.AppendUint32(header, 1)
+	header = binary.LittleEndian.AppendUint32(header, size)
+	header = binary.LittleEndian.AppendUint32(header, b.pos)
+	header = append(header, 0, 0)
+	b.events = append(b.events, append(header, body...))
+}
+
+// 事务开头的GTID_EVENT和BEGIN, 返回事务开始的位置和BEGIN的位置(ROW注释中的开始位置)
+func (b *testBinlog) begin(gno int64) (start, begin uint32) {
+	start = b.pos
+	body := append([]byte{1}, testServerUUID[:]...)
+	body = binary.LittleEndian.AppendUint64(body, uint64(gno))
+	body = append(body, 2)
+	body = append(body, make([]byte, 16)...)
+	b.add(replication.GTID_EVENT, body)
+	begin = b.pos
+	b.query("shop", "BEGIN")
+	return start, begin
+}
+
+func (b *testBinlog) query(schema, query string) {
+	body := make([]byte, 13)
+	body[8] = byte(len(schema))
+	body = append(body, schema...)
+	body = append(body, 0)
+	body = append(body, query...)
+	b.add(replication.QUERY_EVENT, body)
+}
+
+func (b *testBinlog) commit(xid uint64) {
+	b.add(replication.XID_EVENT, binary.LittleEndian.AppendUint64(nil, xid))
+}
+
+// 只有BEGIN和XID的事务, 返回事务开始的位置
+func (b *testBinlog) tx(gno int64) uint32 {
+	start, _ := b.begin(gno)
+	b.commit(uint64(gno))
+	return start
+}
+
+func (b *testBinlog) tableMap(id uint64, table string) {
+	body := binary.LittleEndian.AppendUint32(nil, uint32(id))
+	body = append(body, 0, 0, 0, 0)
+	body = append(body, 4)
+	body = append(body, "shop"...)
+	body = append(body, 0, byte(len(table)))
+	body = append(body, table...)
+	body = append(body, 0)
+	body = append(body, 2, byte(gomysql.MYSQL_TYPE_LONG), byte(gomysql.MYSQL_TYPE_VARCHAR))
+	body = append(body, 2, 80, 0) // varchar(20)的最大字节数
+	body = append(body, 0x02)     // name可以为NULL
+	b.add(replication.TABLE_MAP_EVENT, body)
+}
+
+// 每行为 {int32, string或nil}, UPDATE为before, after交替.
+// event带有STMT_END_F, 之后的ROWS_EVENT之前需要重新添加TABLE_MAP_EVENT
+func (b *testBinlog) rows(typ replication.EventType, id uint64, rows ...[]interface{}) {
+	body := binary.LittleEndian.AppendUint32(nil, uint32(id))
+	body = append(body, 0, 0, 1, 0, 2, 0)
+	body = append(body, 2, 0x03)
+	if typ == replication.UPDATE_ROWS_EVENTv2 {
+		body = append(body, 0x03)
+	}
+	for _, row := range rows {
+		name, ok := row[1].(string)
+		if ok {
+			body = append(body, 0)
+		} else {
+			body = append(body, 0x02)
+		}
+		body = binary.LittleEndian.AppendUint32(body, uint32(row[0].(int32)))
+		if ok {
+			body = append(body, byte(len(name)))
+			body = append(body, name...)
+		}
+	}
+	b.add(typ, body)
+}
+
+func (b *testBinlog) rotate(next string) {
+	body := binary.LittleEndian.AppendUint64(nil, 4)
+	body = append(body, next...)
+	b.add(replication.ROTATE_EVENT, body)
+}
+
+// 写入dir/name, 返回文件的路径
+func (b *testBinlog) save(t *testing.T, dir, name string) string {
+	t.Helper()
+	data := []byte(replication.BinLogFileHeader)
+	for _, event := range b.events {
+		data = append(data, event...)
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const testSchemaDump = `-- MySQL dump
+USE ` + "`shop`" + `;
+CREATE TABLE ` + "`t`" + ` (
+  ` + "`id`" + ` int NOT NULL,
+  ` + "`name`" + ` varchar(20) DEFAULT NULL,
+  PRIMARY KEY (` + "`id`" + `)
+) ENGINE=InnoDB;
+CREATE TABLE ` + "`u`" + ` (
+  ` + "`id`" + ` int NOT NULL,
+  ` + "`name`" + ` varchar(20) DEFAULT NULL,
+  PRIMARY KEY (` + "`id`" + `)
+) ENGINE=InnoDB;
+`
+
+// 离线模式解析dir下的binlog, 表结构为testSchemaDump, 从mysql-bin.000001开始
+func testOfflineConfig(t *testing.T, dir string) *Config {
+	t.Helper()
+	schemaFile := filepath.Join(dir, "schema.sql")
+	if err := os.WriteFile(schemaFile, []byte(testSchemaDump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.SchemaFile = schemaFile
+	cfg.StartFile = filepath.Join(dir, "mysql-bin.000001")
+	cfg.OutputFile = filepath.Join(dir, "output.sql")
+	return cfg
+}
+
+// 执行cfg, 返回输出文件的内容. csv格式的输出为目录, 内容为空
+func runTestFlashback(t *testing.T, cfg *Config) (*Flashback, string, error) {
+	t.Helper()
+	fb, err := NewFlashback(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	err = fb.Flashback()
+	if cfg.Format == FormatCSV {
+		return fb, "", err
+	}
+	output, readErr := os.ReadFile(cfg.OutputFile)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		t.Fatal(readErr)
+	}
+	return fb, string(output), err
+}
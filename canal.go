@@ -0,0 +1,195 @@
+package mysql_flashback
+
+import (
+	"encoding/json"
+	"github.com/juju/errors"
+)
+
+// Canal的FlatMessage. 字段的值都为字符串(NULL为null), 转换规则与csv相同
+type canalMessage struct {
+	Data      []map[string]*string `json:"data"`
+	Database  string               `json:"database"`
+	Es        int64                `json:"es"` // event的时间, 毫秒
+	ID        int64                `json:"id"`
+	IsDdl     bool                 `json:"isDdl"`
+	MysqlType map[string]string    `json:"mysqlType"`
+	Old       []map[string]*string `json:"old"` // UPDATE时修改过的字段的旧值
+	PkNames   []string             `json:"pkNames"`
+	Sql       string               `json:"sql"`
+	SqlType   map[string]int       `json:"sqlType"` // java.sql.Types
+	Table     string               `json:"table"`
+	Ts        int64                `json:"ts"` // 回放历史binlog, 同es
+	Type      string               `json:"type"`
+}
+
+type canalFormatter struct {
+	id int64 // 消息的序号, 从1开始
+}
+
+// 同一个ROWS_EVENT的行合并为一条消息
+func (f *canalFormatter) format(changes []*RowChange) ([]string, error) {
+	var lines []string
+	var message *canalMessage
+	var last *RowChange
+	flush := func() error {
+		if message == nil {
+			return nil
+		}
+		// rollback时文件按行倒序, 消息内的行也要倒序
+		if last.Rollback {
+			reverseCanalRows(message.Data)
+			reverseCanalRows(message.Old)
+		}
+		b, err := json.Marshal(message)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		lines = append(lines, string(b))
+		return nil
+	}
+	for _, change := range changes {
+		if last == nil || change.File != last.File || change.eventPos != last.eventPos || change.Type != last.Type {
+			if err := flush(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			f.id++
+			message = newCanalMessage(f.id, change)
+		}
+		f.addRow(message, change)
+		last = change
+	}
+	if err := flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return lines, nil
+}
+
+func newCanalMessage(id int64, change *RowChange) *canalMessage {
+	tableMetadata := change.tableMetadata
+	message := &canalMessage{
+		Database:  change.Schema,
+		Es:        int64(change.Timestamp) * 1000,
+		ID:        id,
+		MysqlType: make(map[string]string, len(tableMetadata.Fields)),
+		SqlType:   make(map[string]int, len(tableMetadata.Fields)),
+		Table:     change.Table,
+		Ts:        int64(change.Timestamp) * 1000,
+		Type:      change.Type,
+	}
+	for idx, name := range tableMetadata.Fields {
+		column := tableMetadata.Columns[idx]
+		message.MysqlType[name] = canalMysqlType(column)
+		message.SqlType[name] = canalSqlType(column)
+	}
+	for _, idx := range tableMetadata.Keys {
+		message.PkNames = append(message.PkNames, tableMetadata.Fields[idx])
+	}
+	return message
+}
+
+func (f *canalFormatter) addRow(message *canalMessage, change *RowChange) {
+	tableMetadata := change.tableMetadata
+	switch change.Type {
+	case "DELETE":
+		message.Data = append(message.Data, canalRow(tableMetadata, change.before, change.beforePresent, nil))
+	case "UPDATE":
+		message.Data = append(message.Data, canalRow(tableMetadata, change.after, change.afterPresent, nil))
+		// 只包含修改过的字段
+		changed := make(map[int]struct{})
+		for idx := range change.before {
+			if !change.beforePresent.has(idx) || !change.afterPresent.has(idx) {
+				continue
+			}
+			if idx < len(change.after) && buildSqlFieldValue(change.before[idx], tableMetadata.Columns[idx]) != buildSqlFieldValue(change.after[idx], tableMetadata.Columns[idx]) {
+				changed[idx] = struct{}{}
+			}
+		}
+		message.Old = append(message.Old, canalRow(tableMetadata, change.before, change.beforePresent, changed))
+	default:
+		message.Data = append(message.Data, canalRow(tableMetadata, change.after, change.afterPresent, nil))
+	}
+}
+
+// fields为nil时为整行, 没有记录的列不包含在内
+func canalRow(tableMetadata *TableMetadata, row []interface{}, present columnPresence, fields map[int]struct{}) map[string]*string {
+	res := make(map[string]*string, len(row))
+	for idx, value := range row {
+		if !present.has(idx) {
+			continue
+		}
+		if fields != nil {
+			if _, ok := fields[idx]; !ok {
+				continue
+			}
+		}
+		if value == nil {
+			res[tableMetadata.Fields[idx]] = nil
+			continue
+		}
+		text := buildCSVFieldValue(value, tableMetadata.Columns[idx])
+		res[tableMetadata.Fields[idx]] = &text
+	}
+	return res
+}
+
+func reverseCanalRows(rows []map[string]*string) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
+
+func canalMysqlType(column *Column) string {
+	if column == nil {
+		return ""
+	}
+	if column.Unsigned {
+		return column.DataType + " unsigned"
+	}
+	return column.DataType
+}
+
+// 与Canal的映射大致相同
+func canalSqlType(column *Column) int {
+	if column == nil {
+		return 1111 // OTHER
+	}
+	switch column.DataType {
+	case "bit":
+		return -7
+	case "tinyint":
+		return -6
+	case "smallint":
+		return 5
+	case "mediumint", "int", "integer":
+		return 4
+	case "bigint":
+		return -5
+	case "float":
+		return 7
+	case "double", "real":
+		return 8
+	case "decimal", "numeric":
+		return 3
+	case "date":
+		return 91
+	case "time":
+		return 92
+	case "datetime", "timestamp":
+		return 93
+	case "year":
+		return 12
+	case "char", "enum", "set":
+		return 1
+	case "varchar", "json":
+		return 12
+	case "tinytext", "text", "mediumtext", "longtext":
+		return 2005 // CLOB
+	case "binary":
+		return -2
+	case "varbinary":
+		return -3
+	case "tinyblob", "blob", "mediumblob", "longblob":
+		return 2004 // BLOB
+	}
+	return 1111
+}
@@ -0,0 +1,33 @@
+package mysql_flashback
+
+import (
+	"testing"
+)
+
+// 同一个ROWS_EVENT的行合并为一条消息, UPDATE的old只包含修改过的字段
+func TestCanalFormat(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatCanal, false), []string{
+		`{"data":[{"id":"1","name":"a"},{"id":"2","name":null}],"database":"shop","es":1700000000000,"id":1,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":null,"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"INSERT"}`,
+		`{"data":[{"id":"1","name":"b,\"c\""}],"database":"shop","es":1700000000000,"id":2,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":[{"name":"a"}],"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"UPDATE"}`,
+		`{"data":[{"id":"2","name":null}],"database":"shop","es":1700000000000,"id":3,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":null,"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"DELETE"}`,
+	})
+}
+
+// rollback时消息和消息内的行都倒序
+func TestCanalFormatRollback(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatCanal, true), []string{
+		`{"data":[{"id":"2","name":null}],"database":"shop","es":1700000000000,"id":3,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":null,"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"INSERT"}`,
+		`{"data":[{"id":"1","name":"a"}],"database":"shop","es":1700000000000,"id":2,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":[{"name":"b,\"c\""}],"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"UPDATE"}`,
+		`{"data":[{"id":"2","name":null},{"id":"1","name":"a"}],"database":"shop","es":1700000000000,"id":1,"isDdl":false,"mysqlType":{"id":"int","name":"varchar"},"old":null,"pkNames":["id"],"sql":"","sqlType":{"id":4,"name":12},"table":"t","ts":1700000000000,"type":"DELETE"}`,
+	})
+}
+
+// 二进制和空间类型同csv, 为hex字符串
+func TestCanalFormatBinary(t *testing.T) {
+	lines, err := (&canalFormatter{}).format([]*RowChange{testBinaryChange()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`{"data":[{"data":"ff00","geo":"e61000000101000000000000000000f03f0000000000000040","id":"1"}],"database":"shop","es":0,"id":1,"isDdl":false,"mysqlType":{"data":"varbinary","geo":"point","id":"int"},"old":null,"pkNames":["id"],"sql":"","sqlType":{"data":-3,"geo":1111,"id":4},"table":"g","ts":0,"type":"INSERT"}`}
+	testCompareLines(t, lines, want)
+}
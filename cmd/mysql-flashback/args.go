@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/obgnail/mysql-flashback"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// 逗号分隔的列表参数, 直接写入Config中的切片
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = splitVar(value, nil)
+	return nil
+}
+
+// 连接参数、位置等与Config中类型不同的参数先解析到局部变量
+func initVar(cfg *mysql_flashback.Config) (exportSchema string) {
+	var host, user, password string
+	var port, startPos, stopPos, serverID int64
+	flag.StringVar(&host, "h", "127.0.0.1", "mysql host")
+	flag.Int64Var(&port, "P", 3306, "mysql port")
+	flag.StringVar(&user, "u", "root", "mysql user")
+	flag.StringVar(&password, "p", "root", "mysql user password")
+	flag.Var((*listFlag)(&cfg.Databases), "d", "databases you want, separated by comma, support glob (order_*) and /regexp/")
+	flag.Var((*listFlag)(&cfg.OnlyTables), "t", "tables you want, separated by comma, table or db.table, support glob (order_*.order_item) and /regexp/ (matches db.table)")
+	flag.Var((*listFlag)(&cfg.ExcludeDatabases), "exclude-d", "databases to ignore, same format as d, takes precedence over d")
+	flag.Var((*listFlag)(&cfg.ExcludeTables), "exclude-t", "tables to ignore, same format as t, takes precedence over t")
+	flag.StringVar(&cfg.StartFile, "start-file", "", "start binlog file, fomat: mysql-bin.000001")
+	flag.Int64Var(&startPos, "start-pos", 0, "start position in binlog file")
+	flag.StringVar(&cfg.StartTime, "start-time", "", "start time in binlog file, format: 2006-01-02 15:04:05")
+	flag.StringVar(&cfg.StopFile, "stop-file", "", "stop binlog file")
+	flag.Int64Var(&stopPos, "stop-pos", 0, "stop position in binlog file")
+	flag.StringVar(&cfg.GtidRegexp, "gtid-regexp", "", "gitd regexp, match gtid in format uuid:gno")
+	flag.StringVar(&cfg.IncludeGtids, "include-gtids", "", "only parse transactions in this gtid set, format: uuid:1-5:7,uuid2:3")
+	flag.Var((*listFlag)(&cfg.Transactions), "transactions", "only parse these transactions, gtid (uuid:gno), start position (mysql-bin.000026:259) or xid (xid:12345), separated by comma")
+	flag.StringVar(&cfg.ExcludeGtids, "exclude-gtids", "", "ignore transactions in this gtid set, format: uuid:1-5:7,uuid2:3")
+	flag.StringVar(&cfg.StopTime, "stop-time", "", "stop time in binlog file")
+	flag.Var((*listFlag)(&cfg.OnlySqlType), "only-sql-type", "sql type you want")
+	flag.StringVar(&cfg.Where, "where", "", "only rows whose before or after image matches this condition, sql WHERE syntax on column names, e.g. \"tenant_id = 42 AND status IN (1,2)\"")
+	flag.BoolVar(&cfg.OnlyDML, "only-DML", cfg.OnlyDML, "ignore ddl")
+	flag.BoolVar(&cfg.FilterTx, "filter-tx", cfg.FilterTx, "filter transition")
+	flag.StringVar(&cfg.OutputFile, "output", cfg.OutputFile, "output file")
+	flag.BoolVar(&cfg.Rollback, "rollback", false, "rollback")
+	flag.StringVar(&cfg.Format, "format", cfg.Format, "output format: sql, jsonl, csv (output is a directory, one file per table), debezium, canal")
+	flag.BoolVar(&cfg.MinimalUpdate, "minimal-update", cfg.MinimalUpdate, "only SET the columns that differ between before and after image of UPDATE, WHERE follows use-key")
+	flag.Var((*listFlag)(&cfg.ExcludeColumns), "exclude-columns", "columns to drop from output (not rollback), separated by comma, format: column, table.column or db.table.column, support glob")
+	flag.Var((*listFlag)(&cfg.MaskColumns), "mask-columns", "columns to mask in output (not rollback), same format as exclude-columns, suffix :hash for sha256, :mask (default) for ***")
+	flag.BoolVar(&cfg.UseKey, "use-key", cfg.UseKey, "use primary key (or unique key) in WHERE of UPDATE/DELETE")
+	flag.BoolVar(&cfg.Remote, "remote", false, "read binlog from server via replication protocol")
+	flag.Int64Var(&serverID, "server-id", int64(cfg.ServerID), "server id used in remote mode, must be unique in replication topology")
+	flag.StringVar(&cfg.SchemaFile, "schema-file", "", "offline mode: read table schema from mysqldump --no-data file or json snapshot instead of database")
+	flag.BoolVar(&cfg.Offline, "offline", false, "do not connect to database, table schema comes from binlog_row_metadata=FULL or schema-file")
+	flag.BoolVar(&cfg.SchemaHistory, "schema-history", false, "replay ddl in binlog to track historical table schema, start from schema-file which must be taken at start-file")
+	flag.StringVar(&exportSchema, "export-schema", "", "export json schema snapshot of database to this file and exit")
+	flag.BoolVar(&cfg.RemovePartial, "remove-partial", false, "remove the partial output file when interrupted, otherwise keep it (reversed in rollback mode)")
+	flag.StringVar(&cfg.Conflict, "conflict", "", "check later changes to the rolled back rows: report, abort, cascade")
+	flag.BoolVar(&cfg.Verify, "verify", false, "before generating, check whether the rows to roll back still match the binlog, summary per table")
+	flag.BoolVar(&cfg.VerifyOnly, "verify-only", false, "only check the rows like verify, do not generate or apply sql")
+	flag.StringVar(&cfg.ApplyDSN, "apply-dsn", "", "execute the rollback sql on this database after generating, format: user:password@tcp(host:port)/")
+	flag.StringVar(&cfg.ApplyOnMismatch, "apply-on-mismatch", mysql_flashback.ApplyStop, "when UPDATE/DELETE does not affect exactly 1 row: stop, skip (the transaction, exit non-zero at the end)")
+	flag.StringVar(&cfg.ApplyReport, "apply-report", "", "report of applied, skipped and failed sql, default: <output>.report")
+	flag.Parse()
+
+	if startPos < 4 {
+		startPos = 4
+	}
+	cfg.StartPos, cfg.StopPos, cfg.ServerID = uint32(startPos), uint32(stopPos), uint32(serverID)
+	// -d为单个库名(不是模式)时作为连接的默认库
+	if len(cfg.Databases) == 1 && !isPattern(cfg.Databases[0]) {
+		cfg.Database = cfg.Databases[0]
+	}
+	cfg.MysqlUri = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, cfg.Database)
+	return exportSchema
+}
+
+func verifyBinlogFile(file string) bool {
+	list := strings.Split(file, ".")
+	if len(list) < 2 {
+		return false
+	}
+	index := list[len(list)-1]
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
+func verifyVar(cfg *mysql_flashback.Config, exportSchema string) {
+	// 导出schema快照不需要解析binlog
+	if len(exportSchema) != 0 {
+		if len(cfg.Databases) == 0 {
+			log.Fatal("database is empty")
+		}
+		for _, db := range cfg.Databases {
+			if isPattern(db) {
+				log.Fatal("export-schema needs database names, not patterns")
+			}
+		}
+		return
+	}
+	if len(cfg.StartFile) == 0 {
+		log.Fatal("start file is empty")
+	}
+	if !verifyBinlogFile(cfg.StartFile) {
+		log.Fatal("start file format is illegal")
+	}
+	if len(cfg.StopFile) != 0 && !verifyBinlogFile(cfg.StopFile) {
+		log.Fatal("stop file format is illegal")
+	}
+	// 其他参数由NewFlashback检查
+	if len(cfg.OutputFile) == 0 {
+		if !cfg.Rollback {
+			cfg.OutputFile = "raw." + cfg.Format
+		} else {
+			cfg.OutputFile = "rollback." + cfg.Format
+		}
+	}
+}
+
+func splitVar(listVar string, f func(string) string) []string {
+	var res []string
+	if len(listVar) != 0 {
+		for _, v := range strings.Split(listVar, ",") {
+			v = strings.TrimSpace(v)
+			if f != nil {
+				v = f(v)
+			}
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[/")
+}
+
+// 返回的cfg可以直接用于NewFlashback. exportSchema不为空时只导出schema快照, 只用到cfg中的MysqlUri和Databases
+func parseArgs() (cfg *mysql_flashback.Config, exportSchema string) {
+	cfg = mysql_flashback.DefaultConfig()
+	exportSchema = initVar(cfg)
+	verifyVar(cfg, exportSchema)
+	return cfg, exportSchema
+}
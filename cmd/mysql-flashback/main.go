@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/mysql-flashback"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	cfg, exportSchema := parseArgs()
+
+	if exportSchema != "" {
+		err := mysql_flashback.ExportSchemaFile(cfg.MysqlUri, cfg.Databases, exportSchema)
+		if err != nil {
+			log.Fatal(errors.ErrorStack(err))
+		}
+		return
+	}
+
+	fb, err := mysql_flashback.NewFlashback(cfg)
+	if err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
+
+	// 第一次Ctrl-C时结束解析并收尾输出文件, 之后恢复默认行为, 再次Ctrl-C直接退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err = fb.FlashbackContext(ctx)
+	fb.Close()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Fatal(err)
+		}
+		log.Fatal(errors.ErrorStack(err))
+	}
+}
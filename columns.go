@@ -0,0 +1,227 @@
+package mysql_flashback
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"strings"
+)
+
+// 脱敏的方式
+const (
+	MaskFixed = "mask" // 替换为固定的 ***
+	MaskHash  = "hash" // 替换为sha256, 相同的值结果相同
+)
+
+const maskedValue = "***"
+
+// 列的规则: [schema.]table.column 或 column(任意表). 表的格式同OnlyTables, 列为glob, 不区分大小写
+type columnRule struct {
+	table  *namePattern // 为nil则匹配任意表
+	column string
+	mask   string
+}
+
+func parseColumnRule(rule string, withMask bool) (*columnRule, error) {
+	r := &columnRule{}
+	if withMask {
+		r.mask = MaskFixed
+		if idx := strings.LastIndex(rule, ":"); idx != -1 && idx > strings.LastIndex(rule, ".") {
+			rule, r.mask = rule[:idx], strings.ToLower(rule[idx+1:])
+		}
+		if r.mask != MaskFixed && r.mask != MaskHash {
+			return nil, fmt.Errorf("mask must be one of mask, hash: %s", r.mask)
+		}
+	}
+
+	r.column = strings.ToLower(rule)
+	if idx := strings.LastIndex(rule, "."); idx != -1 {
+		table, err := parseNamePattern(rule[:idx], true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.table, r.column = table, strings.ToLower(rule[idx+1:])
+	}
+	if _, err := path.Match(r.column, ""); err != nil || r.column == "" {
+		return nil, fmt.Errorf("column is illegal: %s", rule)
+	}
+	return r, nil
+}
+
+func (r *columnRule) match(tableMetadata *TableMetadata, column string) bool {
+	if r.table != nil && !r.table.match(tableMetadata.Schema, tableMetadata.Table) {
+		return false
+	}
+	ok, _ := path.Match(r.column, strings.ToLower(column))
+	return ok
+}
+
+// 输出时去掉的列(ExcludeColumns)和脱敏的列(MaskColumns)
+type columnRules struct {
+	exclude []*columnRule
+	mask    []*columnRule
+	views   map[*TableMetadata]*columnView
+}
+
+// 表在输出时的样子: 去掉的列不再出现, 其他列的序号依次前移
+type columnView struct {
+	tableMetadata *TableMetadata
+	fields        []int          // 保留的列在原表中的序号
+	masks         map[int]string // map[原表中的序号]脱敏方式
+}
+
+func newColumnRules(exclude, mask []string) (*columnRules, error) {
+	r := &columnRules{views: make(map[*TableMetadata]*columnView)}
+	for _, rule := range exclude {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		c, err := parseColumnRule(rule, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.exclude = append(r.exclude, c)
+	}
+	for _, rule := range mask {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		c, err := parseColumnRule(rule, true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.mask = append(r.mask, c)
+	}
+	if len(r.exclude) == 0 && len(r.mask) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *columnRules) view(tableMetadata *TableMetadata) *columnView {
+	if view, ok := r.views[tableMetadata]; ok {
+		return view
+	}
+
+	view := &columnView{masks: make(map[int]string)}
+	metadata := &TableMetadata{
+		Schema:  tableMetadata.Schema,
+		Table:   tableMetadata.Table,
+		Fields:  make(map[int]string),
+		Columns: make(map[int]*Column),
+	}
+	positions := make(map[int]int) // map[原表中的序号]输出的序号
+	for idx := 0; idx < len(tableMetadata.Fields); idx++ {
+		name := tableMetadata.Fields[idx]
+		if matchColumnRules(r.exclude, tableMetadata, name) != nil {
+			continue
+		}
+		column := tableMetadata.Columns[idx]
+		if rule := matchColumnRules(r.mask, tableMetadata, name); rule != nil {
+			view.masks[idx] = rule.mask
+			// 脱敏后的值是字符串, 按字符串输出
+			masked := &Column{Name: name, DataType: "varchar", Nullable: true}
+			if column != nil {
+				masked.Nullable = column.Nullable
+			}
+			column = masked
+		}
+		positions[idx] = len(view.fields)
+		metadata.Fields[len(view.fields)] = name
+		metadata.Columns[len(view.fields)] = column
+		view.fields = append(view.fields, idx)
+	}
+	// 键的列被去掉时不再使用键, WHERE使用剩下的全部列
+	for _, idx := range tableMetadata.Keys {
+		pos, ok := positions[idx]
+		if !ok {
+			metadata.Keys = nil
+			break
+		}
+		metadata.Keys = append(metadata.Keys, pos)
+	}
+	// 键的列被脱敏时仍然使用键, WHERE中为脱敏后的值, 只用于审计, 不能在数据库中执行
+	for _, idx := range tableMetadata.Keys {
+		if _, ok := view.masks[idx]; ok && metadata.Keys != nil {
+			log.Warnf("key column %s of %s.%s is masked, WHERE of UPDATE/DELETE contains the masked value", tableMetadata.Fields[idx], tableMetadata.Schema, tableMetadata.Table)
+			break
+		}
+	}
+
+	view.tableMetadata = metadata
+	r.views[tableMetadata] = view
+	return view
+}
+
+func matchColumnRules(rules []*columnRule, tableMetadata *TableMetadata, column string) *columnRule {
+	for _, rule := range rules {
+		if rule.match(tableMetadata, column) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 返回输出使用的表结构和只包含输出列(脱敏后)的event. 没有需要处理的列时原样返回
+func (r *columnRules) apply(tableMetadata *TableMetadata, e *replication.BinlogEvent) (*TableMetadata, *replication.BinlogEvent) {
+	view := r.view(tableMetadata)
+	if len(view.masks) == 0 && len(view.fields) == len(tableMetadata.Fields) {
+		return tableMetadata, e
+	}
+
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	rows := make([][]interface{}, len(rowsEvent.Rows))
+	for i, row := range rowsEvent.Rows {
+		values := make([]interface{}, 0, len(view.fields))
+		for _, idx := range view.fields {
+			if idx >= len(row) {
+				break
+			}
+			value := row[idx]
+			if mask, ok := view.masks[idx]; ok {
+				value = maskValue(value, tableMetadata.Columns[idx], mask)
+			}
+			values = append(values, value)
+		}
+		rows[i] = values
+	}
+	projected := *rowsEvent
+	projected.Rows = rows
+	projected.ColumnCount = uint64(len(view.fields))
+	projected.ColumnBitmap1 = projectBitmap(rowsEvent.ColumnBitmap1, view.fields)
+	projected.ColumnBitmap2 = projectBitmap(rowsEvent.ColumnBitmap2, view.fields)
+	event := *e
+	event.Event = &projected
+	return view.tableMetadata, &event
+}
+
+// 行中记录了哪些列(binlog_row_image不为FULL时)也按输出的列重新编号
+func projectBitmap(bitmap []byte, fields []int) []byte {
+	if bitmap == nil {
+		return nil
+	}
+	present := columnPresence(bitmap)
+	res := make([]byte, (len(fields)+7)/8)
+	for pos, idx := range fields {
+		if present.has(idx) {
+			res[pos/8] |= 1 << uint(pos%8)
+		}
+	}
+	return res
+}
+
+// NULL保持为NULL
+func maskValue(value interface{}, column *Column, mask string) interface{} {
+	if value == nil {
+		return nil
+	}
+	if mask == MaskHash {
+		sum := sha256.Sum256([]byte(buildCSVFieldValue(value, column)))
+		return hex.EncodeToString(sum[:])
+	}
+	return maskedValue
+}
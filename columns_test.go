@@ -0,0 +1,224 @@
+package mysql_flashback
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// id int, name varchar, phone varchar, avatar blob
+func testColumnsMetadata() *TableMetadata {
+	return &TableMetadata{
+		Schema: "shop",
+		Table:  "users",
+		Fields: map[int]string{0: "id", 1: "name", 2: "Phone", 3: "avatar"},
+		Columns: map[int]*Column{
+			0: {Name: "id", DataType: "int"},
+			1: {Name: "name", DataType: "varchar", Nullable: true},
+			2: {Name: "Phone", DataType: "varchar"},
+			3: {Name: "avatar", DataType: "blob", Nullable: true},
+		},
+		Keys: []int{0},
+	}
+}
+
+func TestParseColumnRule(t *testing.T) {
+	tableMetadata := testColumnsMetadata()
+	other := &TableMetadata{Schema: "log", Table: "users"}
+	tests := []struct {
+		rule      string
+		withMask  bool
+		wantMask  string
+		match     []string // tableMetadata中匹配的列
+		matchLog  bool     // 是否匹配log.users.phone
+		wantError bool
+	}{
+		{rule: "phone", match: []string{"Phone"}, matchLog: true},
+		{rule: "users.PHONE", match: []string{"Phone"}, matchLog: true},
+		{rule: "shop.users.*a*", match: []string{"name", "avatar"}},
+		{rule: "shop.*.phone", match: []string{"Phone"}},
+		{rule: "phone", withMask: true, wantMask: MaskFixed, match: []string{"Phone"}, matchLog: true},
+		{rule: "users.phone:HASH", withMask: true, wantMask: MaskHash, match: []string{"Phone"}, matchLog: true},
+		{rule: "shop.users.phone:mask", withMask: true, wantMask: MaskFixed, match: []string{"Phone"}},
+		{rule: "phone:md5", withMask: true, wantError: true},
+		{rule: "users.", wantError: true},
+		{rule: "users.[", wantError: true},
+	}
+	for _, tt := range tests {
+		r, err := parseColumnRule(tt.rule, tt.withMask)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("parseColumnRule(%q) want error", tt.rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseColumnRule(%q) error = %v", tt.rule, err)
+			continue
+		}
+		if r.mask != tt.wantMask {
+			t.Errorf("parseColumnRule(%q) mask = %q, want %q", tt.rule, r.mask, tt.wantMask)
+		}
+		var match []string
+		for idx := 0; idx < len(tableMetadata.Fields); idx++ {
+			if r.match(tableMetadata, tableMetadata.Fields[idx]) {
+				match = append(match, tableMetadata.Fields[idx])
+			}
+		}
+		if !reflect.DeepEqual(match, tt.match) {
+			t.Errorf("%q matches %v, want %v", tt.rule, match, tt.match)
+		}
+		if got := r.match(other, "phone"); got != tt.matchLog {
+			t.Errorf("%q matches log.users.phone = %v, want %v", tt.rule, got, tt.matchLog)
+		}
+	}
+}
+
+func TestColumnRulesApply(t *testing.T) {
+	tableMetadata := testColumnsMetadata()
+	rules, err := newColumnRules([]string{"avatar"}, []string{"users.phone:hash", "name", "avatar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowsEvent := &replication.RowsEvent{
+		ColumnCount: 4,
+		// UPDATE的修改前记录了id, phone, avatar, 修改后记录了全部列
+		ColumnBitmap1: []byte{0x0d},
+		ColumnBitmap2: []byte{0x0f},
+		Rows: [][]interface{}{
+			{int32(1), nil, "13800000000", []byte("img")},
+			{int32(1), "alice", "13900000000", nil},
+		},
+	}
+	e := &replication.BinlogEvent{Header: &replication.EventHeader{EventType: replication.UPDATE_ROWS_EVENTv2}, Event: rowsEvent}
+	view, projected := rules.apply(tableMetadata, e)
+
+	// 同时匹配exclude和mask时以去掉为准
+	wantFields := map[int]string{0: "id", 1: "name", 2: "Phone"}
+	if !reflect.DeepEqual(view.Fields, wantFields) {
+		t.Errorf("fields = %v, want %v", view.Fields, wantFields)
+	}
+	if !reflect.DeepEqual(view.Keys, []int{0}) {
+		t.Errorf("keys = %v, want [0]", view.Keys)
+	}
+	// 脱敏的列按字符串输出, 保留原来的nullable
+	if column := view.Columns[2]; column.DataType != "varchar" || column.Nullable {
+		t.Errorf("masked column = %+v", *column)
+	}
+
+	got := projected.Event.(*replication.RowsEvent)
+	hash1, hash2 := got.Rows[0][2], got.Rows[1][2]
+	if hash1 == hash2 || len(hash1.(string)) != 64 {
+		t.Errorf("phone hashes = %v, %v", hash1, hash2)
+	}
+	// NULL保持为NULL
+	want := [][]interface{}{
+		{int32(1), nil, hash1},
+		{int32(1), maskedValue, hash2},
+	}
+	if !reflect.DeepEqual(got.Rows, want) {
+		t.Errorf("rows = %v, want %v", got.Rows, want)
+	}
+	if got.ColumnCount != 3 || !reflect.DeepEqual(got.ColumnBitmap1, []byte{0x05}) || !reflect.DeepEqual(got.ColumnBitmap2, []byte{0x07}) {
+		t.Errorf("column count = %d, bitmaps = %08b, %08b", got.ColumnCount, got.ColumnBitmap1, got.ColumnBitmap2)
+	}
+	// 原来的event不变, 相同的值hash相同
+	if rowsEvent.Rows[0][2] != "13800000000" || rowsEvent.ColumnCount != 4 {
+		t.Errorf("original event modified: %v", rowsEvent.Rows)
+	}
+	if _, again := rules.apply(tableMetadata, e); again.Event.(*replication.RowsEvent).Rows[0][2] != hash1 {
+		t.Errorf("hash of the same value changed")
+	}
+}
+
+func TestColumnRulesKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		exclude  []string
+		mask     []string
+		wantKeys []int
+	}{
+		// 键的列被去掉时WHERE使用剩下的全部列
+		{name: "exclude key", exclude: []string{"id"}, wantKeys: nil},
+		{name: "exclude before key", exclude: []string{"name"}, wantKeys: []int{0}},
+		// 键的列被脱敏时仍然使用键
+		{name: "mask key", mask: []string{"id"}, wantKeys: []int{0}},
+	}
+	for _, tt := range tests {
+		rules, err := newColumnRules(tt.exclude, tt.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view := rules.view(testColumnsMetadata()); !reflect.DeepEqual(view.tableMetadata.Keys, tt.wantKeys) {
+			t.Errorf("%s: keys = %v, want %v", tt.name, view.tableMetadata.Keys, tt.wantKeys)
+		}
+	}
+
+	if rules, err := newColumnRules([]string{" "}, nil); err != nil || rules != nil {
+		t.Errorf("empty rules = %v, %v, want nil", rules, err)
+	}
+}
+
+func TestColumnRulesRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(cfg *Config)
+		wantErr string
+	}{
+		{
+			name:    "mask with rollback",
+			set:     func(cfg *Config) { cfg.Rollback, cfg.MaskColumns = true, []string{"name"} },
+			wantErr: "mask columns can not be used with rollback",
+		},
+		{
+			name:    "exclude with rollback",
+			set:     func(cfg *Config) { cfg.Rollback, cfg.ExcludeColumns = true, []string{"name"} },
+			wantErr: "exclude columns can not be used with rollback or apply dsn",
+		},
+		{
+			name: "exclude with apply",
+			set: func(cfg *Config) {
+				cfg.Rollback, cfg.ApplyDSN, cfg.ExcludeColumns = true, "root:root@tcp(127.0.0.1:3306)/", []string{"name"}
+			},
+			wantErr: "exclude columns can not be used with rollback or apply dsn",
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		newTestBinlog().save(t, dir, "mysql-bin.000001")
+		cfg := testOfflineConfig(t, dir)
+		tt.set(cfg)
+		fb, err := NewFlashback(cfg)
+		if err == nil {
+			fb.Close()
+			t.Errorf("%s: want error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// 键的列被脱敏时WHERE中为脱敏后的值
+func TestMaskKeyColumn(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestBinlog()
+	b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(1), "b"})
+	b.commit(1)
+	b.save(t, dir, "mysql-bin.000001")
+
+	cfg := testOfflineConfig(t, dir)
+	cfg.MaskColumns = []string{"t.id"}
+	_, output, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE `shop`.`t` SET `id`='***', `name`='b' WHERE `id`='***' LIMIT 1;"; !strings.Contains(output, want) {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
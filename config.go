@@ -0,0 +1,84 @@
+package mysql_flashback
+
+// NewFlashback的参数. 建议使用DefaultConfig()获取默认值后再修改
+type Config struct {
+	MysqlUri string // 格式: user:password@tcp(host:port)/database
+
+	// source args
+	Remote        bool   // 通过复制协议从服务端拉取binlog
+	ServerID      uint32 // 远程模式下伪装成slave使用的server id
+	Offline       bool   // 不连接数据库, 表结构来自SchemaFile或binlog_row_metadata=FULL
+	SchemaFile    string // mysqldump --no-data文件或json快照, 非远程模式下指定时自动进入离线模式
+	SchemaHistory bool   // 重放binlog中的DDL, 追踪历史表结构. 需要start-file时刻的SchemaFile
+
+	// filter binlog args
+	StartFile string // 本地模式下为binlog的路径, 远程模式下为binlog的文件名
+	StartPos  uint32
+	StartTime string // 格式: 2006-01-02 15:04:05
+	StopFile  string
+	StopPos   uint32
+	StopTime  string
+
+	// filter event args
+	GtidRegexp   string // 匹配 uuid:gno 格式的gtid
+	IncludeGtids string // 只解析这些gtid的事务, 格式: uuid:1-5:7,uuid2:3
+	ExcludeGtids string // 忽略这些gtid的事务
+	// 只解析这些事务, 格式: gtid(uuid:gno)、事务开始的位置(mysql-bin.000026:259)或xid(xid:12345). 全部找到后结束解析
+	Transactions []string
+	// 库和表的过滤, 支持glob(order_*)和/正则/, 表可以写成 schema.table. exclude优先于include, include为空则不限制
+	Database         string   // 同时作为schema-file中没有USE语句时的默认库
+	Databases        []string // 与Database一起作为include
+	ExcludeDatabases []string
+	OnlyTables       []string
+	ExcludeTables    []string
+	OnlySqlType      []string // INSERT, UPDATE, DELETE, 为空则不过滤
+	OnlyDML          bool     // ignore ddl
+	FilterTx         bool     // filter Transaction event
+	// 行的过滤条件, 语法同sql的WHERE, 如 tenant_id = 42 AND status IN (1,2).
+	// 行修改前或修改后的值满足条件即保留, 为空则不过滤
+	Where string
+
+	// output args
+	OutputFile string // 为空则输出到stdout
+	Rollback   bool   // 生成回滚sql
+	UseKey     bool   // UPDATE/DELETE的WHERE只使用主键(或唯一键). DefaultConfig中为true
+	Format     string // 输出格式: sql(默认), jsonl, csv(OutputFile为目录), debezium, canal
+	// UPDATE的SET只包含修改前后不同的字段, WHERE同UseKey, 没有修改的行不生成sql
+	MinimalUpdate bool
+	// 列的规则, 格式: [schema.]table.column 或 column(任意表), 表同OnlyTables, 列支持glob
+	ExcludeColumns []string // 输出中去掉这些列
+	MaskColumns    []string // 输出中替换这些列的值, 后缀 :hash 为sha256, :mask(默认)为 ***. 不能用于rollback, 键的列被替换时WHERE中也是替换后的值
+
+	// 检查回滚范围之后对同一行的修改: report(只输出), abort(存在冲突时不生成sql), cascade(一并回滚依赖的事务).
+	// 为空则不检查
+	Conflict string
+
+	// 生成回滚sql前按主键查询回滚范围内的行, 统计每个表中与binlog修改后相同、之后被修改、之后被删除的行数.
+	// 指定ApplyDSN时查询ApplyDSN, 否则查询MysqlUri
+	Verify bool
+	// 只校验(同Verify), 不生成sql, 不执行. 结果由VerifySummaries()返回
+	VerifyOnly bool
+
+	// 生成回滚sql后按事务在该数据库上执行, 格式同MysqlUri. 为空则不执行
+	ApplyDSN string
+	// UPDATE/DELETE影响的行数不为1时的处理方式: stop(默认), skip
+	ApplyOnMismatch string
+	// 执行报告, 为空则为 输出文件.report
+	ApplyReport string
+
+	// FlashbackContext被取消时删除已经输出的文件. 默认保留, rollback模式下会对已输出的部分完成倒序
+	RemovePartial bool
+}
+
+// 与命令行参数的默认值相同. 零值的Config中布尔参数都为false(如UseKey), 应使用DefaultConfig创建
+func DefaultConfig() *Config {
+	return &Config{
+		ServerID:    1001,
+		OnlySqlType: []string{"INSERT", "UPDATE", "DELETE"},
+		OnlyDML:     true,
+		FilterTx:    true,
+		OutputFile:  stdout,
+		UseKey:      true,
+		Format:      FormatSQL,
+	}
+}
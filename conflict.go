@@ -0,0 +1,303 @@
+package mysql_flashback
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 发现冲突时的处理方式
+const (
+	ConflictReport  = "report"  // 只输出冲突, 继续生成回滚sql
+	ConflictAbort   = "abort"   // 存在冲突时不生成回滚sql
+	ConflictCascade = "cascade" // 同时回滚依赖回滚范围的事务
+)
+
+// 回滚范围之后对同一行的修改. 回滚时该行已经不是binlog中的样子, 回滚sql可能匹配不到或覆盖之后的修改
+type Conflict struct {
+	Schema string
+	Table  string
+	Key    string // 行的标识, 如 `id`=3
+	Type   string // 之后修改的类型: INSERT, UPDATE, DELETE
+	GTID   string // 之后修改所在的事务, 没有开启gtid时为空
+	File   string
+	Pos    uint32 // 事务开始的位置
+	EndPos uint32 // ROWS_EVENT结束的位置
+	Time   uint32
+}
+
+func (c *Conflict) String() string {
+	gtid := c.GTID
+	if gtid == "" {
+		gtid = "ANONYMOUS"
+	}
+	return fmt.Sprintf("`%s`.`%s` %s changed by %s | gtid: %s | binlog: %s | pos: (%d, %d) | time: %s",
+		c.Schema, c.Table, c.Key, c.Type, gtid, c.File, c.Pos, c.EndPos,
+		time.Unix(int64(c.Time), 0).Format(layout))
+}
+
+// 从StartFile开始扫描到binlog的最新位置:
+//   - 回滚范围内的ROWS_EVENT, 按表和主键(没有键时为整行)记录修改过的行
+//   - 之后的ROWS_EVENT修改了记录过的行即为冲突
+//
+// cascade时冲突的事务作为依赖加入回滚范围, 其修改的行也需要记录, 以便找到间接依赖的事务
+type conflictScanner struct {
+	fb        *Flashback // 独立的副本, 只用于判断event是否在回滚范围内
+	cascade   bool
+	pastRange bool
+	touched   map[string]struct{} // 回滚范围(及依赖的事务)修改过的行
+
+	txStart     BinlogPosition // 当前事务开始的位置(GTID_EVENT)
+	txKeys      []string       // 当前事务修改的行
+	txDependent bool           // 当前事务修改了记录过的行
+
+	conflicts  []*Conflict
+	dependents map[BinlogPosition]string // cascade时依赖的事务
+}
+
+func newConflictScanner(fb *Flashback) *conflictScanner {
+	clone := fb.scanner()
+	clone.dependents = nil
+	return &conflictScanner{
+		fb:         clone,
+		cascade:    fb.conflictPolicy == ConflictCascade,
+		touched:    make(map[string]struct{}),
+		dependents: make(map[BinlogPosition]string),
+	}
+}
+
+func (s *conflictScanner) streamFunc(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+	fb := s.fb
+	if binlog.name != fb.position.File {
+		fb.skipTx = false
+		fb.dependentTx = false
+	}
+	fb.position = BinlogPosition{File: binlog.name, Pos: e.Header.LogPos}
+	if err := fb.prepare(dbm, binlog, e); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch e.Header.EventType {
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT:
+		s.endTx()
+		s.txStart = BinlogPosition{File: binlog.name, Pos: e.Header.LogPos - e.Header.EventSize}
+	case replication.XID_EVENT:
+		defer s.endTx()
+	}
+
+	if !s.pastRange {
+		event, err := fb.filterEvent(dbm, binlog, e)
+		if err == nil {
+			if event != nil && isRowsEvent(e.Header.EventType) {
+				if err := s.track(dbm, event); err != nil {
+					return errors.Trace(err)
+				}
+				// 部分行不满足where时, 这些行不会回滚, 同样可能与回滚的行冲突
+				if event == e {
+					return nil
+				}
+				if dropped := s.fb.droppedRows(dbm, e); dropped != nil {
+					return errors.Trace(s.check(dbm, binlog, dropped))
+				}
+				return nil
+			}
+			// 回滚范围内被过滤的修改(如没有选中的事务、不满足where的行)也可能与回滚的行冲突
+			if event == nil && isRowsEvent(e.Header.EventType) {
+				return errors.Trace(s.check(dbm, binlog, e))
+			}
+			return nil
+		}
+		s.pastRange = true
+	}
+	if isRowsEvent(e.Header.EventType) {
+		return errors.Trace(s.check(dbm, binlog, e))
+	}
+	return nil
+}
+
+func (s *conflictScanner) track(dbm *DBMap, e *replication.BinlogEvent) error {
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	tableMetadata, ok := dbm.LookupTableMetadata(rowsEvent.TableID)
+	if !ok {
+		return fmt.Errorf("%w: %s.%s, table id: %d", ErrTableMetadataMissing, rowsEvent.Table.Schema, rowsEvent.Table.Table, rowsEvent.TableID)
+	}
+	for i := range rowsEvent.Rows {
+		row, _ := rowAt(rowsEvent, i)
+		s.touched[rowKey(tableMetadata, row)] = struct{}{}
+	}
+	return nil
+}
+
+func (s *conflictScanner) check(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	// 被过滤的表不会回滚, 也没有表结构
+	if !s.fb.tableFilter.match(string(rowsEvent.Table.Schema), string(rowsEvent.Table.Table)) {
+		return nil
+	}
+	tableMetadata, ok := dbm.LookupTableMetadata(rowsEvent.TableID)
+	if !ok {
+		return fmt.Errorf("%w: %s.%s, table id: %d", ErrTableMetadataMissing, rowsEvent.Table.Schema, rowsEvent.Table.Table, rowsEvent.TableID)
+	}
+	// cascade时依赖的事务按sql类型和where过滤后回滚, 只有回滚的行之后的修改才依赖该事务
+	if kept := s.fb.filterRows(dbm, e); kept != nil {
+		keptRows := kept.Event.(*replication.RowsEvent)
+		for i := range keptRows.Rows {
+			row, _ := rowAt(keptRows, i)
+			s.txKeys = append(s.txKeys, rowKey(tableMetadata, row))
+		}
+	}
+	reported := make(map[string]struct{}) // UPDATE修改前后的行标识可能相同, 只报告一次
+	for i := range rowsEvent.Rows {
+		row, _ := rowAt(rowsEvent, i)
+		key := rowKey(tableMetadata, row)
+		if _, ok := s.touched[key]; !ok {
+			continue
+		}
+		if _, ok := reported[key]; ok {
+			continue
+		}
+		reported[key] = struct{}{}
+		s.txDependent = true
+		s.conflicts = append(s.conflicts, &Conflict{
+			Schema: tableMetadata.Schema,
+			Table:  tableMetadata.Table,
+			Key:    strings.TrimPrefix(key, tableKeyPrefix(tableMetadata)),
+			Type:   rowsEventType(e.Header.EventType),
+			GTID:   s.fb.gtid,
+			File:   binlog.name,
+			Pos:    s.txStart.Pos,
+			EndPos: e.Header.LogPos,
+			Time:   e.Header.Timestamp,
+		})
+	}
+	return nil
+}
+
+// 依赖回滚范围的事务修改的行也会被回滚, 之后修改这些行的事务同样依赖回滚范围
+func (s *conflictScanner) endTx() {
+	if s.txDependent && s.cascade {
+		s.dependents[s.txStart] = fmt.Sprintf("%s:%d", s.txStart.File, s.txStart.Pos)
+		for _, key := range s.txKeys {
+			s.touched[key] = struct{}{}
+		}
+	}
+	s.txKeys = s.txKeys[:0]
+	s.txDependent = false
+}
+
+// cascade时依赖的事务, 按位置排序
+func (s *conflictScanner) dependentTxs() []string {
+	res := make([]string, 0, len(s.dependents))
+	for _, tx := range s.dependents {
+		res = append(res, tx)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// 复制出用于预先扫描binlog的Flashback, 过滤条件相同, 解析状态独立. 不会输出sql
+func (fb *Flashback) scanner() *Flashback {
+	clone := *fb
+	clone.dbm = fb.dbm.fork()
+	clone.gtidFilter = fb.gtidFilter.clone()
+	clone.txSelector = fb.txSelector.clone()
+	clone.dependents = fb.dependents.clone()
+	clone.position = BinlogPosition{}
+	return &clone
+}
+
+// ROWS_EVENT中不满足where的行, 没有where或没有表结构时为nil
+func (fb *Flashback) droppedRows(dbm *DBMap, e *replication.BinlogEvent) *replication.BinlogEvent {
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	tableMetadata, ok := dbm.LookupTableMetadata(rowsEvent.TableID)
+	if !ok || fb.rowFilter == nil {
+		return nil
+	}
+	_, dropped := fb.rowFilter.split(tableMetadata, e)
+	return dropped
+}
+
+// 扫描冲突. abort时存在冲突返回ErrConflict, cascade时依赖的事务会在之后的解析中一并回滚
+func (fb *Flashback) checkConflicts(ctx context.Context) error {
+	scanner := newConflictScanner(fb)
+	if err := fb.stream(ctx, scanner.fb.dbm, scanner.streamFunc); err != nil {
+		return errors.Trace(err)
+	}
+	scanner.endTx()
+
+	fb.conflicts = scanner.conflicts
+	for _, conflict := range fb.conflicts {
+		log.Warnf("conflict: %s", conflict)
+	}
+	switch fb.conflictPolicy {
+	case ConflictAbort:
+		if len(fb.conflicts) != 0 {
+			return fmt.Errorf("%w: %d rows changed after rollback range", ErrConflict, len(fb.conflicts))
+		}
+	case ConflictCascade:
+		if txs := scanner.dependentTxs(); len(txs) != 0 {
+			log.Infof("rollback dependent transactions: %s", strings.Join(txs, ", "))
+			dependents, err := newTxSelector(txs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			fb.dependents = dependents
+		}
+	}
+	return nil
+}
+
+// 回滚范围之后发现的冲突, 需要开启Config.Conflict
+func (fb *Flashback) Conflicts() []*Conflict {
+	return fb.conflicts
+}
+
+// 表的主键(没有键时为整行)作为行的标识
+func rowKey(tableMetadata *TableMetadata, row []interface{}) string {
+	keys := tableMetadata.Keys
+	if len(keys) == 0 {
+		keys = make([]int, len(row))
+		for idx := range row {
+			keys[idx] = idx
+		}
+	}
+	res := make([]string, 0, len(keys))
+	for _, idx := range keys {
+		if idx >= len(row) {
+			continue
+		}
+		value := buildSqlFieldValue(row[idx], tableMetadata.Columns[idx])
+		res = append(res, buildEqualExp(tableMetadata.Fields[idx], value, true))
+	}
+	return tableKeyPrefix(tableMetadata) + strings.Join(res, " AND ")
+}
+
+func tableKeyPrefix(tableMetadata *TableMetadata) string {
+	return fmt.Sprintf("`%s`.`%s` ", tableMetadata.Schema, tableMetadata.Table)
+}
+
+func isRowsEvent(t replication.EventType) bool {
+	switch t {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2,
+		replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+		replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		return true
+	}
+	return false
+}
+
+func rowsEventType(t replication.EventType) string {
+	switch t {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return "INSERT"
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		return "UPDATE"
+	default:
+		return "DELETE"
+	}
+}
@@ -0,0 +1,59 @@
+package mysql_flashback
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestConflictScanner(t *testing.T) {
+	b := newTestBinlog()
+	b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(1), "b"})
+	b.commit(1)
+	// 同一个event中id=2满足where被回滚, id=1不满足where, 但修改了回滚的行
+	b.begin(2)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1,
+		[]interface{}{int32(2), "a"}, []interface{}{int32(2), "c"},
+		[]interface{}{int32(1), "b"}, []interface{}{int32(1), "c"})
+	b.commit(2)
+	stopPos := b.pos
+	// 回滚范围之后修改了id=2, id=3没有被回滚
+	third, _ := b.begin(3)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1,
+		[]interface{}{int32(2), "c"}, []interface{}{int32(2), "d"},
+		[]interface{}{int32(3), "a"}, []interface{}{int32(3), "b"})
+	b.commit(3)
+
+	dir := t.TempDir()
+	b.save(t, dir, "mysql-bin.000001")
+	cfg := testOfflineConfig(t, dir)
+	cfg.StopFile = cfg.StartFile
+	cfg.StopPos = stopPos
+	cfg.Rollback = true
+	cfg.Where = "name = 'a'"
+	cfg.Conflict = ConflictReport
+	fb, _, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range fb.Conflicts() {
+		got = append(got, c.Key+" "+c.GTID)
+	}
+	want := []string{
+		"`id`=1 3e11fa47-71ca-11e1-9e33-c80aa9429562:2",
+		"`id`=2 3e11fa47-71ca-11e1-9e33-c80aa9429562:3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("conflicts = %q, want %q", got, want)
+	}
+	if c := fb.Conflicts()[1]; c.Type != "UPDATE" || c.File != "mysql-bin.000001" || c.Pos != third {
+		t.Errorf("conflict = %s, want UPDATE in mysql-bin.000001 at %d", c, third)
+	}
+}
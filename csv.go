@@ -0,0 +1,258 @@
+package mysql_flashback
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// csv中NULL的表示, 同mysql的LOAD DATA
+const csvNull = `\N`
+
+// 一个表的csv文件. 表结构在解析范围内发生变化时, 新的结构写入另一个文件
+type csvTable struct {
+	path   string
+	header []string
+	file   *os.File
+	writer *csv.Writer
+}
+
+// csv模式下每个表一个文件: <dir>/<schema>.<table>.csv
+type csvOutput struct {
+	dir    string
+	tables map[string]*csvTable // map[schema.table]当前写入的文件
+	paths  []string             // 创建过的所有文件
+}
+
+func newCSVOutput(dir string) (*csvOutput, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &csvOutput{dir: dir, tables: make(map[string]*csvTable)}, nil
+}
+
+func csvHeader(tableMetadata *TableMetadata) []string {
+	header := []string{"type", "time", "file", "start_pos", "end_pos", "gtid", "xid"}
+	for idx := 0; idx < len(tableMetadata.Fields); idx++ {
+		header = append(header, "before_"+tableMetadata.Fields[idx])
+	}
+	for idx := 0; idx < len(tableMetadata.Fields); idx++ {
+		header = append(header, "after_"+tableMetadata.Fields[idx])
+	}
+	return header
+}
+
+func (o *csvOutput) table(tableMetadata *TableMetadata) (*csvTable, error) {
+	key := snapshotKey(tableMetadata.Schema, tableMetadata.Table)
+	header := csvHeader(tableMetadata)
+	table, ok := o.tables[key]
+	if ok && equalStrings(table.header, header) {
+		return table, nil
+	}
+
+	name := fmt.Sprintf("%s.%s.csv", tableMetadata.Schema, tableMetadata.Table)
+	if ok {
+		if err := table.close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for n := 2; ; n++ {
+			name = fmt.Sprintf("%s.%s.%d.csv", tableMetadata.Schema, tableMetadata.Table, n)
+			if !o.created(filepath.Join(o.dir, name)) {
+				break
+			}
+		}
+	}
+
+	path := filepath.Join(o.dir, name)
+	file, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	table = &csvTable{path: path, header: header, file: file, writer: csv.NewWriter(file)}
+	if err := table.writer.Write(header); err != nil {
+		file.Close()
+		return nil, errors.Trace(err)
+	}
+	o.tables[key] = table
+	o.paths = append(o.paths, path)
+	return table, nil
+}
+
+func (o *csvOutput) created(path string) bool {
+	for _, p := range o.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *csvOutput) write(change *RowChange) error {
+	table, err := o.table(change.tableMetadata)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	xid := ""
+	if change.Xid != 0 {
+		xid = strconv.FormatUint(change.Xid, 10)
+	}
+	record := []string{
+		change.Type,
+		time.Unix(int64(change.Timestamp), 0).Format(layout),
+		change.File,
+		strconv.FormatUint(uint64(change.StartPos), 10),
+		strconv.FormatUint(uint64(change.EndPos), 10),
+		change.GTID,
+		xid,
+	}
+	record = append(record, csvRowValues(change.tableMetadata, change.before, change.beforePresent)...)
+	record = append(record, csvRowValues(change.tableMetadata, change.after, change.afterPresent)...)
+	return errors.Trace(table.writer.Write(record))
+}
+
+// 没有的行(如INSERT的before)和没有记录的列(binlog_row_image不为FULL)为空
+func csvRowValues(tableMetadata *TableMetadata, row []interface{}, present columnPresence) []string {
+	values := make([]string, len(tableMetadata.Fields))
+	for idx := range values {
+		if !present.has(idx) {
+			continue
+		}
+		if idx < len(row) {
+			values[idx] = buildCSVFieldValue(row[idx], tableMetadata.Columns[idx])
+		} else if row != nil {
+			values[idx] = csvNull
+		}
+	}
+	return values
+}
+
+// 与json相同的规则转换为文本, 引号和换行由csv.Writer处理
+func buildCSVFieldValue(value interface{}, column *Column) string {
+	switch v := buildJSONFieldValue(value, column).(type) {
+	case nil:
+		return csvNull
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case json.RawMessage:
+		return string(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func (t *csvTable) close() error {
+	t.writer.Flush()
+	if err := t.writer.Error(); err != nil {
+		t.file.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.file.Close())
+}
+
+func (o *csvOutput) close() error {
+	var err error
+	for _, table := range o.tables {
+		if closeErr := table.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return errors.Trace(err)
+}
+
+func (o *csvOutput) remove() error {
+	for _, path := range o.paths {
+		if err := os.Remove(path); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// rollback模式下按记录倒序, 表头保持在第一行. 值中可能有换行, 不能按行倒序
+func (o *csvOutput) reverse() error {
+	for _, path := range o.paths {
+		if err := reverseCSVFile(path); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func reverseCSVFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	records, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for i, j := 1, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	tempName := path + ".temp"
+	temp, err := os.OpenFile(tempName, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writer := csv.NewWriter(temp)
+	if err := writer.WriteAll(records); err != nil {
+		temp.Close()
+		return errors.Trace(err)
+	}
+	if err := temp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tempName, path))
+}
+
+// 写入失败后关闭outputFailed并丢弃剩余的变更, 避免解析端阻塞
+func (fb *Flashback) outputCSV() {
+	var err error
+	for change := range fb.changeChan {
+		if err != nil {
+			continue
+		}
+		if err = fb.csv.write(change); err != nil {
+			err = errors.Trace(err)
+			close(fb.outputFailed)
+		}
+	}
+	if closeErr := fb.csv.close(); closeErr != nil && err == nil {
+		err = errors.Trace(closeErr)
+	}
+	switch {
+	case err != nil:
+	case fb.discard:
+		err = fb.csv.remove()
+	case fb.flashback:
+		err = fb.csv.reverse()
+	}
+
+	fb.exitChan <- err
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
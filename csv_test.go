@@ -0,0 +1,110 @@
+package mysql_flashback
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func testReadCSV(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// 输出testFormatBinlog, 返回shop.t.csv的内容, {time}为event的时间
+func testCSVOutput(t *testing.T, rollback bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	testFormatBinlog(t, dir)
+	cfg := testOfflineConfig(t, dir)
+	cfg.Format = FormatCSV
+	cfg.OutputFile = filepath.Join(dir, "csv")
+	cfg.Rollback = rollback
+	if _, _, err := runTestFlashback(t, cfg); err != nil {
+		t.Fatal(err)
+	}
+	output := testReadCSV(t, filepath.Join(cfg.OutputFile, "shop.t.csv"))
+	return strings.ReplaceAll(output, time.Unix(testBinlogTime, 0).Format(layout), "{time}")
+}
+
+const testCSVHeader = "type,time,file,start_pos,end_pos,gtid,xid,before_id,before_name,after_id,after_name\n"
+
+func TestCSVFormat(t *testing.T) {
+	want := testCSVHeader +
+		"INSERT,{time},mysql-bin.000001,186,314,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,,,1,a\n" +
+		"INSERT,{time},mysql-bin.000001,186,314,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,,,2,\\N\n" +
+		"UPDATE,{time},mysql-bin.000001,186,407,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,1,a,1,\"b,\"\"c\"\"\"\n" +
+		"DELETE,{time},mysql-bin.000001,186,486,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,2,\\N,,\n"
+	if got := testCSVOutput(t, false); got != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// rollback时按记录倒序, 表头保持在第一行
+func TestCSVFormatRollback(t *testing.T) {
+	want := testCSVHeader +
+		"INSERT,{time},mysql-bin.000001,186,486,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,,,2,\\N\n" +
+		"UPDATE,{time},mysql-bin.000001,186,407,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,1,\"b,\"\"c\"\"\",1,a\n" +
+		"DELETE,{time},mysql-bin.000001,186,314,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,2,\\N,,\n" +
+		"DELETE,{time},mysql-bin.000001,186,314,3e11fa47-71ca-11e1-9e33-c80aa9429562:1,7,1,a,,\n"
+	if got := testCSVOutput(t, true); got != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// 表结构变化时新的结构写入另一个文件, 变回原来的结构时也不会覆盖之前的文件
+func TestCSVOutputHeaderRotation(t *testing.T) {
+	before := &TableMetadata{
+		Schema:  "shop",
+		Table:   "t",
+		Fields:  map[int]string{0: "id", 1: "name"},
+		Columns: map[int]*Column{0: {Name: "id", DataType: "int"}, 1: {Name: "name", DataType: "varchar"}},
+		Keys:    []int{0},
+	}
+	changes := func(tableMetadata *TableMetadata, row []interface{}) []*RowChange {
+		e := testRowsEvent(replication.WRITE_ROWS_EVENTv2, []byte{0x07}, nil, row)
+		return newRowChanges(tableMetadata, e, false)
+	}
+	var all []*RowChange
+	all = append(all, changes(before, []interface{}{int32(1), "a"})...)
+	all = append(all, changes(testRowImageMetadata, []interface{}{int32(2), "b", []byte{0xff}})...)
+	all = append(all, changes(before, []interface{}{int32(3), nil})...)
+
+	dir := t.TempDir()
+	output, err := newCSVOutput(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range all {
+		change.Timestamp = testBinlogTime
+		if err := output.write(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventTime := time.Unix(testBinlogTime, 0).Format(layout)
+	files := map[string]string{
+		"shop.t.csv": "type,time,file,start_pos,end_pos,gtid,xid,before_id,before_name,after_id,after_name\n" +
+			"INSERT," + eventTime + ",,0,0,,,,,1,a\n",
+		"shop.t.2.csv": "type,time,file,start_pos,end_pos,gtid,xid,before_id,before_name,before_content,after_id,after_name,after_content\n" +
+			"INSERT," + eventTime + ",,0,0,,,,,,2,b,ff\n",
+		"shop.t.3.csv": "type,time,file,start_pos,end_pos,gtid,xid,before_id,before_name,after_id,after_name\n" +
+			"INSERT," + eventTime + ",,0,0,,,,,3,\\N\n",
+	}
+	for name, want := range files {
+		if got := testReadCSV(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+}
@@ -3,97 +3,368 @@ package mysql_flashback
 import (
 	"database/sql"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	driver "github.com/go-sql-driver/mysql"
 	"github.com/juju/errors"
+	"reflect"
 	"strings"
 )
 
 func LinkDB(uri string) (*DBMap, error) {
-	db, err := sql.Open("mysql", uri)
+	dsn, err := utcDSN(uri)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, errors.Trace(err)
 	}
 
 	return NewDBMap(db), nil
 }
 
+// 离线模式下没有连接, 直接返回
+func (dbm *DBMap) Close() error {
+	if dbm.db == nil {
+		return nil
+	}
+	return errors.Trace(dbm.db.Close())
+}
+
+// 会话的时区设置为UTC, 与binlog中TIMESTAMP的输出(SqlTimeZone)一致
+func setUTCTimeZone(cfg *driver.Config) {
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+}
+
+func utcDSN(dsn string) (string, error) {
+	cfg, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	setUTCTimeZone(cfg)
+	return cfg.FormatDSN(), nil
+}
+
 type TableMetadata struct {
-	Schema string
-	Table  string
-	Fields map[int]string // map[idx]columnName （idx: field在table中的idx）
+	Schema  string
+	Table   string
+	Fields  map[int]string  // map[idx]columnName （idx: field在table中的idx）
+	Columns map[int]*Column // map[idx]column, 用于按字段类型生成sql字面量
+	Keys    []int           // 主键的field idx, 无主键时为第一个非空唯一键, 都没有则为空
+}
+
+type Column struct {
+	Name     string   `json:"name"`
+	DataType string   `json:"data_type"`          // 小写的DATA_TYPE, 如 int, varchar, decimal, enum
+	Unsigned bool     `json:"unsigned,omitempty"` // 整数类型是否为unsigned
+	Nullable bool     `json:"nullable,omitempty"`
+	Elements []string `json:"elements,omitempty"` // ENUM/SET的成员, 按定义顺序
+}
+
+// BINARY/VARBINARY/BLOB 需要以hex形式输出
+func (c *Column) IsBinary() bool {
+	switch c.DataType {
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return true
+	}
+	return false
+}
+
+// 空间类型, binlog中为mysql内部格式(SRID + WKB)
+func (c *Column) IsGeometry() bool {
+	switch c.DataType {
+	case "geometry", "point", "linestring", "polygon", "multipoint",
+		"multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+		return true
+	}
+	return false
+}
+
+// FLOAT/DOUBLE是近似值, 与sql字面量比较时可能不相等
+func (c *Column) IsApproximate() bool {
+	switch c.DataType {
+	case "float", "double", "real":
+		return true
+	}
+	return false
 }
 
 type DBMap struct {
 	tableMetadataMap map[uint64]*TableMetadata
-	fieldsCache      map[string]map[int]string // map[schema_table]Fields
-	db               *sql.DB
+	metadataCache    map[string]*TableMetadata // map[schema.table]TableMetadata
+	eventMetadata    map[string]*eventMetadata // map[schema.table]最近一次由TABLE_MAP_EVENT生成的表结构
+	provider         SchemaProvider
+	history          *SchemaHistory // 未开启表结构历史时为nil
+	db               *sql.DB        // 离线模式下为nil
+}
+
+type eventMetadata struct {
+	tableSchema *TableSchema
+	metadata    *TableMetadata
 }
 
 func NewDBMap(db *sql.DB) *DBMap {
 	return &DBMap{
 		db:               db,
+		provider:         &dbSchemaProvider{db: db},
 		tableMetadataMap: make(map[uint64]*TableMetadata),
-		fieldsCache:      make(map[string]map[int]string),
+		metadataCache:    make(map[string]*TableMetadata),
+		eventMetadata:    make(map[string]*eventMetadata),
 	}
 }
 
+// 离线模式: 不连接数据库, 表结构全部来自provider
+func NewOfflineDBMap(provider SchemaProvider) *DBMap {
+	return &DBMap{
+		provider:         provider,
+		tableMetadataMap: make(map[uint64]*TableMetadata),
+		metadataCache:    make(map[string]*TableMetadata),
+		eventMetadata:    make(map[string]*eventMetadata),
+	}
+}
+
+// 开启表结构历史: 以当前provider为起点, 之后按binlog顺序重放DDL
+func (m *DBMap) EnableSchemaHistory() {
+	m.history = NewSchemaHistory(m.provider)
+	m.provider = m.history
+}
+
+// 复制出独立的DBMap, 共享数据库连接和表结构来源, 表结构历史从头开始重放
+func (m *DBMap) fork() *DBMap {
+	n := &DBMap{
+		db:               m.db,
+		provider:         m.provider,
+		tableMetadataMap: make(map[uint64]*TableMetadata),
+		metadataCache:    make(map[string]*TableMetadata),
+		eventMetadata:    make(map[string]*eventMetadata),
+	}
+	if m.history != nil {
+		n.provider = m.history.base
+		n.EnableSchemaHistory()
+	}
+	return n
+}
+
+// 未开启表结构历史时忽略
+func (m *DBMap) ApplyDDL(pos BinlogPosition, schema string, query string) error {
+	if m.history == nil {
+		return nil
+	}
+	changed, err := m.history.Apply(pos, schema, query)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range changed {
+		delete(m.metadataCache, key)
+	}
+	return nil
+}
+
 func (m *DBMap) LookupTableMetadata(id uint64) (*TableMetadata, bool) {
 	val, ok := m.tableMetadataMap[id]
 	return val, ok
 }
 
-func (m *DBMap) Add(id uint64, schema, table string) error {
-	fields, err := m.getFields(schema, table)
+// 优先使用TABLE_MAP_EVENT自带的字段信息(binlog_row_metadata=FULL), 没有时才去provider查询
+func (m *DBMap) Add(tableMapEvent *replication.TableMapEvent) error {
+	id := tableMapEvent.TableID
+	if tableSchema, ok := tableSchemaFromEvent(tableMapEvent); ok {
+		// 每个事务都有TABLE_MAP_EVENT, 结构没有变化时复用同一个TableMetadata, 以它为key的缓存不会一直增长
+		key := snapshotKey(tableSchema.Schema, tableSchema.Table)
+		if cached, ok := m.eventMetadata[key]; ok && reflect.DeepEqual(cached.tableSchema, tableSchema) {
+			m.tableMetadataMap[id] = cached.metadata
+			return nil
+		}
+		metadata, err := tableSchema.Metadata()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		m.eventMetadata[key] = &eventMetadata{tableSchema: tableSchema, metadata: metadata}
+		m.tableMetadataMap[id] = metadata
+		return nil
+	}
+
+	schema := string(tableMapEvent.Schema)
+	table := string(tableMapEvent.Table)
+	metadata, err := m.getTableMetadata(schema, table)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	m.tableMetadataMap[id] = &TableMetadata{schema, table, fields}
+	m.tableMetadataMap[id] = metadata
 	return nil
 }
 
-func (m *DBMap) getFields(schema, table string) (map[int]string, error) {
-	cacheKey := fmt.Sprintf("%s_%s", schema, table)
-	if cachedFields, ok := m.fieldsCache[cacheKey]; ok {
-		return cachedFields, nil
+func (m *DBMap) getTableMetadata(schema, table string) (*TableMetadata, error) {
+	cacheKey := snapshotKey(schema, table)
+	if cachedMetadata, ok := m.metadataCache[cacheKey]; ok {
+		return cachedMetadata, nil
+	}
+
+	tableSchema, err := m.provider.TableSchema(schema, table)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
+	metadata, err := tableSchema.Metadata()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	m.metadataCache[cacheKey] = metadata
+
+	return metadata, nil
+}
+
+// 从INFORMATION_SCHEMA读取表结构
+type dbSchemaProvider struct {
+	db *sql.DB
+}
 
-	fields, err := getFieldsFromDb(m.db, schema, table)
-	m.fieldsCache[cacheKey] = fields
+func (p *dbSchemaProvider) TableSchema(schema, table string) (*TableSchema, error) {
+	return getTableSchemaFromDb(p.db, schema, table)
+}
+
+func getTableSchemaFromDb(db *sql.DB, schema string, table string) (*TableSchema, error) {
+	columns, err := getColumnsFromDb(db, schema, table)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%w: table not found: %s.%s", ErrTableMetadataMissing, schema, table)
+	}
 
-	return fields, nil
+	tableSchema := &TableSchema{Schema: schema, Table: table, Columns: columns}
+	if err := fillKeysFromDb(db, tableSchema); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return tableSchema, nil
 }
 
-//  map[idx]columnName
-func getFieldsFromDb(db *sql.DB, schema string, table string) (map[int]string, error) {
-	sql := "SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION"
+func getColumnsFromDb(db *sql.DB, schema string, table string) ([]*Column, error) {
+	sql := "SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION"
 	rows, err := db.Query(sql, schema, table)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	defer rows.Close()
 
-	fields := make(map[int]string)
-	i := 0
-
-	var columnName string
+	var columns []*Column
+	var columnName, dataType, columnType, nullable string
 	for rows.Next() {
-		if err := rows.Scan(&columnName); err != nil {
+		if err := rows.Scan(&columnName, &dataType, &columnType, &nullable); err != nil {
 			return nil, errors.Trace(err)
 		}
 
-		fields[i] = columnName
-		i++
+		column := newColumn(columnName, dataType, columnType)
+		column.Nullable = strings.ToUpper(nullable) == "YES"
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+// columnType为INFORMATION_SCHEMA.COLUMNS.COLUMN_TYPE, 如 int(10) unsigned, enum('a','b')
+func newColumn(name, dataType, columnType string) *Column {
+	dataType = strings.ToLower(dataType)
+	column := &Column{
+		Name:     name,
+		DataType: dataType,
+		Unsigned: strings.Contains(strings.ToLower(columnType), "unsigned"),
+	}
+	if dataType == "enum" || dataType == "set" {
+		column.Elements = parseElements(columnType)
+	}
+	return column
+}
+
+// 解析 enum('a','b') / set('x','y') 中的成员, 成员内的单引号以两个单引号转义
+func parseElements(columnType string) []string {
+	start := strings.Index(columnType, "(")
+	end := strings.LastIndex(columnType, ")")
+	if start == -1 || end <= start {
+		return nil
 	}
 
-	return fields, nil
+	var elements []string
+	var buf strings.Builder
+	inQuote := false
+	body := columnType[start+1 : end]
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case !inQuote && c == '\'':
+			inQuote = true
+			buf.Reset()
+		case inQuote && c == '\'' && i+1 < len(body) && body[i+1] == '\'':
+			buf.WriteByte('\'')
+			i++
+		case inQuote && c == '\'':
+			inQuote = false
+			elements = append(elements, buf.String())
+		case inQuote && c == '\\' && i+1 < len(body):
+			buf.WriteByte(body[i+1])
+			i++
+		case inQuote:
+			buf.WriteByte(c)
+		}
+	}
+	return elements
+}
+
+// 读取主键和唯一键
+func fillKeysFromDb(db *sql.DB, tableSchema *TableSchema) error {
+	sql := "SELECT INDEX_NAME, COLUMN_NAME FROM INFORMATION_SCHEMA.STATISTICS " +
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 0 " +
+		"ORDER BY INDEX_NAME = 'PRIMARY' DESC, INDEX_NAME, SEQ_IN_INDEX"
+	rows, err := db.Query(sql, tableSchema.Schema, tableSchema.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var current *UniqueKey
+	var indexName, columnName string
+	for rows.Next() {
+		if err := rows.Scan(&indexName, &columnName); err != nil {
+			return errors.Trace(err)
+		}
+		if indexName == "PRIMARY" {
+			tableSchema.PrimaryKey = append(tableSchema.PrimaryKey, columnName)
+			continue
+		}
+		if current == nil || current.Name != indexName {
+			current = &UniqueKey{Name: indexName}
+			tableSchema.UniqueKeys = append(tableSchema.UniqueKeys, current)
+		}
+		current.Columns = append(current.Columns, columnName)
+	}
+	return errors.Trace(rows.Err())
+}
+
+func getTablesFromDb(db *sql.DB, schema string) ([]string, error) {
+	sql := "SELECT TABLE_NAME FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_NAME"
+	rows, err := db.Query(sql, schema)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	var table string
+	for rows.Next() {
+		if err := rows.Scan(&table); err != nil {
+			return nil, errors.Trace(err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
 }
 
 type BinlogInfo struct {
@@ -144,6 +415,22 @@ func getGitdModeFromDb(db *sql.DB) (ok bool, err error) {
 	return strings.ToUpper(status) == "ON", nil
 }
 
+// 低版本没有binlog_row_image时为FULL
+func getBinlogRowImageFromDb(db *sql.DB) (string, error) {
+	rows, err := db.Query("SELECT @@GLOBAL.binlog_row_image;")
+	if err != nil {
+		return "FULL", nil
+	}
+	defer rows.Close()
+	image := "FULL"
+	for rows.Next() {
+		if err := rows.Scan(&image); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	return strings.ToUpper(image), nil
+}
+
 func getBinlogDirFromDb(db *sql.DB) (dirname string, err error) {
 	sql := `SHOW variables WHERE Variable_name = "log_bin_basename";`
 	rows, err := db.Query(sql)
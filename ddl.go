@@ -0,0 +1,369 @@
+package mysql_flashback
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/mysql"
+	_ "github.com/pingcap/tidb/parser/test_driver"
+	"github.com/pingcap/tidb/parser/types"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	createTableRegexp = regexp.MustCompile(`(?i)^\s*CREATE\s+(TEMPORARY\s+)?TABLE`)
+
+	// tidb parser不支持空间类型, 解析前替换为longblob. binlog中的geometry与blob一样以hex输出, 因此不影响结果
+	spatialTypeRegexp = regexp.MustCompile("(?i)(`[^`]+`\\s+)(geometrycollection|geomcollection|multilinestring|multipolygon|multipoint|linestring|polygon|geometry|point)\\b")
+	sridRegexp        = regexp.MustCompile(`(?i)(/\*!\d+\s+)?SRID\s+\d+(\s*\*/)?`)
+	spatialKeyRegexp  = regexp.MustCompile(`(?i)\bSPATIAL\s+(KEY|INDEX)\b`)
+)
+
+func rewriteSpatialTypes(statement string) string {
+	statement = spatialTypeRegexp.ReplaceAllString(statement, "${1}longblob")
+	statement = sridRegexp.ReplaceAllString(statement, "")
+	return spatialKeyRegexp.ReplaceAllString(statement, "$1")
+}
+
+// 解析一条语句, 失败时尝试替换空间类型后重新解析
+func parseStatement(p *parser.Parser, statement string) (ast.StmtNode, error) {
+	stmt, err := p.ParseOneStmt(statement, "", "")
+	if err == nil {
+		return stmt, nil
+	}
+	if rewritten := rewriteSpatialTypes(statement); rewritten != statement {
+		if stmt, err2 := p.ParseOneStmt(rewritten, "", ""); err2 == nil {
+			return stmt, nil
+		}
+	}
+	return nil, errors.Trace(err)
+}
+
+// 解析mysqldump --no-data生成的文件, 只关心USE和CREATE TABLE语句
+func LoadDumpSchema(file string, defaultSchema string) (*SchemaSnapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	statements, err := splitStatements(f)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	snapshot := NewSchemaSnapshot()
+	p := parser.New()
+	schema := defaultSchema
+	for _, statement := range statements {
+		stmt, err := parseStatement(p, statement)
+		if err != nil {
+			if createTableRegexp.MatchString(statement) {
+				log.Warnf("skip unsupported create table statement: %s", err)
+			}
+			continue
+		}
+
+		switch stmt := stmt.(type) {
+		case *ast.UseStmt:
+			schema = stmt.DBName
+		case *ast.CreateTableStmt:
+			tableSchema := tableSchemaFromCreateStmt(snapshot, stmt, schema)
+			if tableSchema != nil {
+				snapshot.Put(tableSchema)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// 按行切分sql语句, 支持DELIMITER
+func splitStatements(f *os.File) ([]string, error) {
+	var statements []string
+	var buf strings.Builder
+	delimiter := ";"
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if buf.Len() == 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+				continue
+			}
+			if strings.HasPrefix(strings.ToUpper(trimmed), "DELIMITER ") {
+				delimiter = strings.TrimSpace(trimmed[len("DELIMITER "):])
+				continue
+			}
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		if strings.HasSuffix(trimmed, delimiter) {
+			statement := strings.TrimSpace(buf.String())
+			statements = append(statements, strings.TrimSuffix(statement, delimiter))
+			buf.Reset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if buf.Len() != 0 {
+		statements = append(statements, buf.String())
+	}
+	return statements, nil
+}
+
+// CREATE TABLE ... LIKE 时从snapshot中复制表结构, 找不到时返回nil
+func tableSchemaFromCreateStmt(snapshot *SchemaSnapshot, stmt *ast.CreateTableStmt, defaultSchema string) *TableSchema {
+	schema := stmt.Table.Schema.O
+	if schema == "" {
+		schema = defaultSchema
+	}
+	table := stmt.Table.Name.O
+
+	if stmt.ReferTable != nil {
+		referSchema := stmt.ReferTable.Schema.O
+		if referSchema == "" {
+			referSchema = defaultSchema
+		}
+		refer, err := snapshot.TableSchema(referSchema, stmt.ReferTable.Name.O)
+		if err != nil {
+			return nil
+		}
+		tableSchema := refer.clone()
+		tableSchema.Schema, tableSchema.Table = schema, table
+		return tableSchema
+	}
+
+	tableSchema := &TableSchema{Schema: schema, Table: table}
+	for _, def := range stmt.Cols {
+		tableSchema.Columns = append(tableSchema.Columns, columnFromDef(def))
+		tableSchema.addColumnKeys(def)
+	}
+	for _, constraint := range stmt.Constraints {
+		tableSchema.addConstraint(constraint)
+	}
+	return tableSchema
+}
+
+func columnFromDef(def *ast.ColumnDef) *Column {
+	tp := def.Tp
+	column := &Column{
+		Name:     def.Name.Name.O,
+		DataType: types.TypeToStr(tp.GetType(), tp.GetCharset()),
+		Unsigned: mysql.HasUnsignedFlag(tp.GetFlag()),
+		Nullable: true,
+		Elements: tp.GetElems(),
+	}
+	for _, option := range def.Options {
+		switch option.Tp {
+		case ast.ColumnOptionNotNull, ast.ColumnOptionPrimaryKey:
+			column.Nullable = false
+		}
+	}
+	return column
+}
+
+// 字段定义中的 PRIMARY KEY / UNIQUE
+func (t *TableSchema) addColumnKeys(def *ast.ColumnDef) {
+	name := def.Name.Name.O
+	for _, option := range def.Options {
+		switch option.Tp {
+		case ast.ColumnOptionPrimaryKey:
+			t.PrimaryKey = []string{name}
+		case ast.ColumnOptionUniqKey:
+			t.UniqueKeys = append(t.UniqueKeys, &UniqueKey{Name: name, Columns: []string{name}})
+		}
+	}
+}
+
+func (t *TableSchema) addConstraint(constraint *ast.Constraint) {
+	var columns []string
+	for _, key := range constraint.Keys {
+		if key.Column == nil {
+			return // 函数索引无法用于定位行
+		}
+		columns = append(columns, key.Column.Name.O)
+	}
+
+	switch constraint.Tp {
+	case ast.ConstraintPrimaryKey:
+		t.PrimaryKey = columns
+		for _, column := range t.Columns {
+			for _, name := range columns {
+				if strings.EqualFold(column.Name, name) {
+					column.Nullable = false
+				}
+			}
+		}
+	case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+		name := constraint.Name
+		if name == "" {
+			name = columns[0]
+		}
+		t.UniqueKeys = append(t.UniqueKeys, &UniqueKey{Name: name, Columns: columns})
+	}
+}
+
+func (t *TableSchema) clone() *TableSchema {
+	res := &TableSchema{
+		Schema:     t.Schema,
+		Table:      t.Table,
+		Columns:    make([]*Column, len(t.Columns)),
+		PrimaryKey: append([]string(nil), t.PrimaryKey...),
+		UniqueKeys: make([]*UniqueKey, len(t.UniqueKeys)),
+	}
+	for i, column := range t.Columns {
+		c := *column
+		c.Elements = append([]string(nil), column.Elements...)
+		res.Columns[i] = &c
+	}
+	for i, key := range t.UniqueKeys {
+		res.UniqueKeys[i] = &UniqueKey{Name: key.Name, Columns: append([]string(nil), key.Columns...)}
+	}
+	return res
+}
+
+func (t *TableSchema) columnIndex(name string) int {
+	for idx, column := range t.Columns {
+		if strings.EqualFold(column.Name, name) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// 按ast.ColumnPosition将column插入到合适的位置. 字段已存在说明起点的表结构与binlog不一致
+func (t *TableSchema) insertColumn(column *Column, position *ast.ColumnPosition) error {
+	if t.columnIndex(column.Name) != -1 {
+		return fmt.Errorf("column already exists: %s.%s.%s", t.Schema, t.Table, column.Name)
+	}
+	idx := len(t.Columns)
+	if position != nil {
+		switch position.Tp {
+		case ast.ColumnPositionFirst:
+			idx = 0
+		case ast.ColumnPositionAfter:
+			if after := t.columnIndex(position.RelativeColumn.Name.O); after != -1 {
+				idx = after + 1
+			}
+		}
+	}
+	t.Columns = append(t.Columns, nil)
+	copy(t.Columns[idx+1:], t.Columns[idx:])
+	t.Columns[idx] = column
+	return nil
+}
+
+func (t *TableSchema) missingColumn(name string) error {
+	return fmt.Errorf("column not exists: %s.%s.%s", t.Schema, t.Table, name)
+}
+
+func (t *TableSchema) removeColumn(name string) error {
+	idx := t.columnIndex(name)
+	if idx == -1 {
+		return t.missingColumn(name)
+	}
+	t.Columns = append(t.Columns[:idx], t.Columns[idx+1:]...)
+
+	// 删除字段时, mysql会把该字段从索引中移除, 索引为空时删除索引
+	t.PrimaryKey = removeName(t.PrimaryKey, name)
+	keys := t.UniqueKeys[:0]
+	for _, key := range t.UniqueKeys {
+		key.Columns = removeName(key.Columns, name)
+		if len(key.Columns) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	t.UniqueKeys = keys
+	return nil
+}
+
+// CHANGE/MODIFY COLUMN: 替换字段定义, position不为空时移动字段
+func (t *TableSchema) replaceColumn(oldName string, def *ast.ColumnDef, position *ast.ColumnPosition) error {
+	idx := t.columnIndex(oldName)
+	if idx == -1 {
+		return t.missingColumn(oldName)
+	}
+	column := columnFromDef(def)
+	if other := t.columnIndex(column.Name); other != -1 && other != idx {
+		return fmt.Errorf("column already exists: %s.%s.%s", t.Schema, t.Table, column.Name)
+	}
+	t.renameKeyColumn(oldName, column.Name)
+	if position == nil || position.Tp == ast.ColumnPositionNone {
+		t.Columns[idx] = column
+	} else {
+		t.Columns = append(t.Columns[:idx], t.Columns[idx+1:]...)
+		if err := t.insertColumn(column, position); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	t.addColumnKeys(def)
+	return nil
+}
+
+func (t *TableSchema) renameColumn(oldName, newName string) error {
+	idx := t.columnIndex(oldName)
+	if idx == -1 {
+		return t.missingColumn(oldName)
+	}
+	if other := t.columnIndex(newName); other != -1 && other != idx {
+		return fmt.Errorf("column already exists: %s.%s.%s", t.Schema, t.Table, newName)
+	}
+	t.Columns[idx].Name = newName
+	t.renameKeyColumn(oldName, newName)
+	return nil
+}
+
+func (t *TableSchema) renameKeyColumn(oldName, newName string) {
+	for i, name := range t.PrimaryKey {
+		if strings.EqualFold(name, oldName) {
+			t.PrimaryKey[i] = newName
+		}
+	}
+	for _, key := range t.UniqueKeys {
+		for i, name := range key.Columns {
+			if strings.EqualFold(name, oldName) {
+				key.Columns[i] = newName
+			}
+		}
+	}
+}
+
+func (t *TableSchema) dropIndex(name string) {
+	if strings.EqualFold(name, "PRIMARY") {
+		t.PrimaryKey = nil
+		return
+	}
+	for i, key := range t.UniqueKeys {
+		if strings.EqualFold(key.Name, name) {
+			t.UniqueKeys = append(t.UniqueKeys[:i], t.UniqueKeys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *TableSchema) renameIndex(oldName, newName string) {
+	for _, key := range t.UniqueKeys {
+		if strings.EqualFold(key.Name, oldName) {
+			key.Name = newName
+		}
+	}
+}
+
+func removeName(names []string, name string) []string {
+	var res []string
+	for _, n := range names {
+		if !strings.EqualFold(n, name) {
+			res = append(res, n)
+		}
+	}
+	return res
+}
@@ -0,0 +1,250 @@
+package mysql_flashback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDumpFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "schema.sql")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testKeyNames(t *testing.T, tableSchema *TableSchema) []string {
+	t.Helper()
+	tableMetadata, err := tableSchema.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, idx := range tableMetadata.Keys {
+		names = append(names, tableMetadata.Fields[idx])
+	}
+	return names
+}
+
+// testdata/shop_nodata.sql: mysqldump --no-data --databases shop log --triggers 的输出
+func TestLoadDumpSchemaFixture(t *testing.T) {
+	snapshot, err := LoadDumpSchema("testdata/shop_nodata.sql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for _, tableSchema := range snapshot.Tables() {
+		tables = append(tables, snapshotKey(tableSchema.Schema, tableSchema.Table))
+	}
+	// 视图和触发器不是表
+	if want := []string{"log.audit", "shop.order", "shop.store", "shop.user"}; !reflect.DeepEqual(tables, want) {
+		t.Fatalf("tables = %v, want %v", tables, want)
+	}
+
+	order, _ := snapshot.TableSchema("shop", "order")
+	wantColumns := []*Column{
+		{Name: "id", DataType: "bigint", Unsigned: true},
+		{Name: "tenant_id", DataType: "int"},
+		{Name: "status", DataType: "enum", Elements: []string{"new", "paid", "shipped"}},
+		{Name: "tags", DataType: "set", Nullable: true, Elements: []string{"gift", "urgent"}},
+		{Name: "amount", DataType: "decimal"},
+		{Name: "note", DataType: "text", Nullable: true},
+		{Name: "created_at", DataType: "datetime"},
+	}
+	if !reflect.DeepEqual(order.Columns, wantColumns) {
+		for i, column := range order.Columns {
+			t.Logf("column %d: %+v", i, *column)
+		}
+		t.Fatalf("shop.order columns mismatch")
+	}
+
+	// 空间类型按longblob解析
+	store, _ := snapshot.TableSchema("shop", "store")
+	if got := columnNames(store); !reflect.DeepEqual(got, []string{"id", "location", "area"}) {
+		t.Fatalf("shop.store columns = %v", got)
+	}
+	if store.Columns[1].DataType != "longblob" || store.Columns[1].Nullable || !store.Columns[2].Nullable {
+		t.Errorf("shop.store location = %+v, area = %+v", *store.Columns[1], *store.Columns[2])
+	}
+
+	tests := []struct {
+		schema, table string
+		wantKey       []string
+	}{
+		{"shop", "order", []string{"id"}},
+		// uk_phone可以为NULL, 不能定位行
+		{"shop", "user", []string{"email"}},
+		// SPATIAL KEY不是唯一键
+		{"shop", "store", []string{"id"}},
+		{"log", "audit", []string{"seq"}},
+	}
+	for _, tt := range tests {
+		tableSchema, err := snapshot.TableSchema(tt.schema, tt.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testKeyNames(t, tableSchema); !reflect.DeepEqual(got, tt.wantKey) {
+			t.Errorf("%s.%s key = %v, want %v", tt.schema, tt.table, got, tt.wantKey)
+		}
+	}
+}
+
+func TestSplitStatementsDelimiter(t *testing.T) {
+	file := testDumpFile(t, `-- comment
+CREATE TABLE a (id int);
+
+DELIMITER ;;
+CREATE TRIGGER a_bi BEFORE INSERT ON a FOR EACH ROW BEGIN
+  SET NEW.id = 1;
+END;;
+DELIMITER $$
+CREATE PROCEDURE p() BEGIN SELECT 1; END$$
+DELIMITER ;
+CREATE TABLE b (
+  id int
+);
+SELECT 1`)
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	statements, err := splitStatements(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE a (id int)",
+		"CREATE TRIGGER a_bi BEFORE INSERT ON a FOR EACH ROW BEGIN\n  SET NEW.id = 1;\nEND",
+		"CREATE PROCEDURE p() BEGIN SELECT 1; END",
+		"CREATE TABLE b (\n  id int\n)",
+		"SELECT 1\n",
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Errorf("statements = %q, want %q", statements, want)
+	}
+}
+
+func TestRewriteSpatialTypes(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      string
+	}{
+		{
+			statement: "CREATE TABLE s (`id` int, `g` geometry NOT NULL, `p` point /*!80003 SRID 4326 */, SPATIAL KEY `idx_g` (`g`))",
+			want:      "CREATE TABLE s (`id` int, `g` longblob NOT NULL, `p` longblob , KEY `idx_g` (`g`))",
+		},
+		{
+			statement: "ALTER TABLE s ADD COLUMN `c` GEOMCOLLECTION SRID 0, ADD SPATIAL INDEX `idx_c` (`c`)",
+			want:      "ALTER TABLE s ADD COLUMN `c` longblob , ADD INDEX `idx_c` (`c`)",
+		},
+		// 列名中的类型名不替换
+		{
+			statement: "CREATE TABLE s (`point` int, `polygon_id` int)",
+			want:      "CREATE TABLE s (`point` int, `polygon_id` int)",
+		},
+	}
+	for _, tt := range tests {
+		if got := rewriteSpatialTypes(tt.statement); got != tt.want {
+			t.Errorf("rewriteSpatialTypes(%q) = %q, want %q", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDumpSchemaKeys(t *testing.T) {
+	file := testDumpFile(t, `
+CREATE TABLE pk_and_uk (
+  id int NOT NULL,
+  code varchar(8) NOT NULL,
+  UNIQUE KEY uk_code (code),
+  PRIMARY KEY (id)
+);
+CREATE TABLE inline_pk (id int PRIMARY KEY, name varchar(8));
+CREATE TABLE inline_uk (a int, b int NOT NULL UNIQUE);
+CREATE TABLE composite (
+  a int NOT NULL,
+  b int,
+  c int NOT NULL,
+  UNIQUE KEY uk_ab (a, b),
+  UNIQUE KEY uk_ac (a, c)
+);
+CREATE TABLE nullable_uk (a int, UNIQUE KEY uk_a (a));
+CREATE TABLE functional (a int NOT NULL, UNIQUE KEY uk_f ((a + 1)));
+`)
+	snapshot, err := LoadDumpSchema(file, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		table   string
+		wantKey []string
+	}{
+		// 主键优先于定义在前面的唯一键
+		{"pk_and_uk", []string{"id"}},
+		{"inline_pk", []string{"id"}},
+		{"inline_uk", []string{"b"}},
+		// 第一个所有列都NOT NULL的唯一键
+		{"composite", []string{"a", "c"}},
+		{"nullable_uk", nil},
+		{"functional", nil},
+	}
+	for _, tt := range tests {
+		tableSchema, err := snapshot.TableSchema("shop", tt.table)
+		if err != nil {
+			t.Errorf("%s: %v", tt.table, err)
+			continue
+		}
+		if got := testKeyNames(t, tableSchema); !reflect.DeepEqual(got, tt.wantKey) {
+			t.Errorf("%s key = %v, want %v", tt.table, got, tt.wantKey)
+		}
+	}
+
+	inlinePK, _ := snapshot.TableSchema("shop", "inline_pk")
+	if inlinePK.Columns[0].Nullable {
+		t.Errorf("inline primary key column is nullable")
+	}
+}
+
+func TestLoadDumpSchemaLike(t *testing.T) {
+	file := testDumpFile(t, `
+USE shop;
+CREATE TABLE a (id int NOT NULL, name varchar(8), PRIMARY KEY (id));
+CREATE TABLE b LIKE a;
+CREATE TABLE archive.c LIKE shop.a;
+CREATE TABLE d LIKE missing;
+`)
+	snapshot, err := LoadDumpSchema(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := snapshot.TableSchema("shop", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"shop.b", "archive.c"} {
+		list := strings.SplitN(name, ".", 2)
+		like, err := snapshot.TableSchema(list[0], list[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if like.Schema != list[0] || like.Table != list[1] {
+			t.Errorf("%s: got %s.%s", name, like.Schema, like.Table)
+		}
+		if !reflect.DeepEqual(like.Columns, a.Columns) || !reflect.DeepEqual(like.PrimaryKey, a.PrimaryKey) {
+			t.Errorf("%s: got columns %v, key %v", name, columnNames(like), like.PrimaryKey)
+		}
+	}
+	// 复制的是副本, 修改不影响原表
+	b, _ := snapshot.TableSchema("shop", "b")
+	b.Columns[1].Name = "changed"
+	if a.Columns[1].Name != "name" {
+		t.Errorf("CREATE TABLE LIKE shares columns with the refer table")
+	}
+	if _, err := snapshot.TableSchema("shop", "d"); err == nil {
+		t.Errorf("CREATE TABLE LIKE a missing table should be skipped")
+	}
+}
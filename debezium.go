@@ -0,0 +1,124 @@
+package mysql_flashback
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/juju/errors"
+)
+
+const (
+	debeziumVersion    = "2.5.0.Final"     // 事件格式兼容的Debezium版本
+	debeziumServerName = "mysql-flashback" // 相当于connector的topic.prefix
+)
+
+// Debezium MySQL connector事件的source块
+type debeziumSource struct {
+	Version   string  `json:"version"`
+	Connector string  `json:"connector"`
+	Name      string  `json:"name"`
+	TsMs      int64   `json:"ts_ms"`
+	Snapshot  string  `json:"snapshot"`
+	DB        string  `json:"db"`
+	Table     string  `json:"table"`
+	ServerID  uint32  `json:"server_id"`
+	GTID      *string `json:"gtid"`
+	File      string  `json:"file"`
+	Pos       uint32  `json:"pos"` // ROWS_EVENT开始的位置
+	Row       int     `json:"row"` // 在ROWS_EVENT中的序号
+	Thread    *int64  `json:"thread"`
+	Query     *string `json:"query"`
+}
+
+// Debezium的事件(value部分, 不含schema). 字段的值与jsonl相同, 相当于decimal.handling.mode=string, 时间类型为字符串.
+// 二进制类型同默认的binary.handling.mode=bytes, 为base64; 空间类型为Geometry结构(wkb为base64, srid)
+type debeziumEvent struct {
+	Before      map[string]interface{} `json:"before"`
+	After       map[string]interface{} `json:"after"`
+	Source      debeziumSource         `json:"source"`
+	Op          string                 `json:"op"` // c, u, d
+	TsMs        int64                  `json:"ts_ms"`
+	Transaction interface{}            `json:"transaction"`
+}
+
+type debeziumFormatter struct{}
+
+func (debeziumFormatter) format(changes []*RowChange) ([]string, error) {
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		b, err := json.Marshal(newDebeziumEvent(change))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		lines = append(lines, string(b))
+	}
+	return lines, nil
+}
+
+// 回放历史binlog, ts_ms为event的时间而不是处理的时间
+func newDebeziumEvent(change *RowChange) *debeziumEvent {
+	var gtid *string
+	if change.GTID != "" {
+		gtid = &change.GTID
+	}
+	tsMs := int64(change.Timestamp) * 1000
+	return &debeziumEvent{
+		Before: debeziumImage(change.tableMetadata, change.Before, change.before, change.beforePresent),
+		After:  debeziumImage(change.tableMetadata, change.After, change.after, change.afterPresent),
+		Source: debeziumSource{
+			Version:   debeziumVersion,
+			Connector: "mysql",
+			Name:      debeziumServerName,
+			TsMs:      tsMs,
+			Snapshot:  "false",
+			DB:        change.Schema,
+			Table:     change.Table,
+			ServerID:  change.serverID,
+			GTID:      gtid,
+			File:      change.File,
+			Pos:       change.eventPos,
+			Row:       change.row,
+		},
+		Op:   debeziumOp(change.Type),
+		TsMs: tsMs,
+	}
+}
+
+// image为jsonl中的值, 只替换其中的二进制和空间类型
+func debeziumImage(tableMetadata *TableMetadata, image map[string]interface{}, row []interface{}, present columnPresence) map[string]interface{} {
+	if image == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(image))
+	for name, value := range image {
+		res[name] = value
+	}
+	for idx, value := range row {
+		column := tableMetadata.Columns[idx]
+		if value == nil || column == nil || !present.has(idx) {
+			continue
+		}
+		b := toBytes(value)
+		switch {
+		case column.IsGeometry() && len(b) >= 4:
+			res[tableMetadata.Fields[idx]] = map[string]interface{}{
+				"wkb":  base64.StdEncoding.EncodeToString(b[4:]),
+				"srid": binary.LittleEndian.Uint32(b[:4]),
+			}
+		case column.IsBinary():
+			res[tableMetadata.Fields[idx]] = base64.StdEncoding.EncodeToString(b)
+		}
+	}
+	return res
+}
+
+func debeziumOp(typ string) string {
+	switch typ {
+	case "INSERT":
+		return "c"
+	case "UPDATE":
+		return "u"
+	default:
+		return "d"
+	}
+}
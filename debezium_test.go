@@ -0,0 +1,65 @@
+package mysql_flashback
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestDebeziumFormat(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatDebezium, false), []string{
+		`{"before":null,"after":{"id":1,"name":"a"},"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":271,"row":0,"thread":null,"query":null},"op":"c","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":null,"after":{"id":2,"name":null},"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":271,"row":1,"thread":null,"query":null},"op":"c","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":{"id":1,"name":"a"},"after":{"id":1,"name":"b,\"c\""},"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":357,"row":0,"thread":null,"query":null},"op":"u","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":{"id":2,"name":null},"after":null,"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":450,"row":0,"thread":null,"query":null},"op":"d","ts_ms":1700000000000,"transaction":null}`,
+	})
+}
+
+// rollback时输出回滚操作, source仍为原来的位置
+func TestDebeziumFormatRollback(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatDebezium, true), []string{
+		`{"before":null,"after":{"id":2,"name":null},"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":450,"row":0,"thread":null,"query":null},"op":"c","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":{"id":1,"name":"b,\"c\""},"after":{"id":1,"name":"a"},"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":357,"row":0,"thread":null,"query":null},"op":"u","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":{"id":2,"name":null},"after":null,"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":271,"row":1,"thread":null,"query":null},"op":"d","ts_ms":1700000000000,"transaction":null}`,
+		`{"before":{"id":1,"name":"a"},"after":null,"source":{"version":"2.5.0.Final","connector":"mysql","name":"mysql-flashback","ts_ms":1700000000000,"snapshot":"false","db":"shop","table":"t","server_id":1,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","file":"mysql-bin.000001","pos":271,"row":0,"thread":null,"query":null},"op":"d","ts_ms":1700000000000,"transaction":null}`,
+	})
+}
+
+// id int, data varbinary, geo point
+var testBinaryMetadata = &TableMetadata{
+	Schema: "shop",
+	Table:  "g",
+	Fields: map[int]string{0: "id", 1: "data", 2: "geo"},
+	Columns: map[int]*Column{
+		0: {Name: "id", DataType: "int"},
+		1: {Name: "data", DataType: "varbinary", Nullable: true},
+		2: {Name: "geo", DataType: "point", Nullable: true},
+	},
+	Keys: []int{0},
+}
+
+// SRID 4326 + POINT(1 2)的WKB
+var testPoint = []byte{
+	0xe6, 0x10, 0x00, 0x00,
+	0x01, 0x01, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40,
+}
+
+func testBinaryChange() *RowChange {
+	e := testRowsEvent(replication.WRITE_ROWS_EVENTv2, []byte{0x07}, nil, []interface{}{int32(1), []byte{0xff, 0x00}, testPoint})
+	return newRowChanges(testBinaryMetadata, e, false)[0]
+}
+
+// 二进制为base64, 空间类型为 {wkb, srid}
+func TestDebeziumImageBinary(t *testing.T) {
+	b, err := json.Marshal(newDebeziumEvent(testBinaryChange()).After)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"data":"/wA=","geo":{"srid":4326,"wkb":"AQEAAAAAAAAAAADwPwAAAAAAAABA"},"id":1}`
+	if string(b) != want {
+		t.Errorf("after = %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,23 @@
+package mysql_flashback
+
+import (
+	"errors"
+)
+
+// 可用errors.Is判断的错误类型
+var (
+	// start-file/stop-file不存在, 或已经被purge
+	ErrBinlogNotFound = errors.New("binlog not found")
+	// start-pos超出了binlog文件的大小
+	ErrPositionOutOfRange = errors.New("position out of range")
+	// 无法获取ROWS_EVENT对应的表结构
+	ErrTableMetadataMissing = errors.New("table metadata missing")
+	// 解析完成后仍没有找到指定的事务
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// 回滚范围之后有对同一行的修改, 且冲突处理方式为abort
+	ErrConflict = errors.New("rollback conflict")
+	// 执行回滚sql出错, 或UPDATE/DELETE影响的行数不为1(处理方式为skip时在执行完后返回)
+	ErrApplyFailed = errors.New("apply failed")
+	// binlog_row_image为MINIMAL/NOBLOB时, 修改前的行缺少回滚需要的列
+	ErrIncompleteRowImage = errors.New("incomplete row image")
+)
@@ -6,31 +6,23 @@ import (
 	"log"
 )
 
+// 作为库使用: 生成 mysql-bin.000001 中 test.user 表的回滚sql
 func main() {
-	mysqlUri := mysql_flashback.MysqlURI
-	startLog := mysql_flashback.StartFile
-	startPos := mysql_flashback.StartPosition
-	startTime := mysql_flashback.StartTime
-	stopLog := mysql_flashback.StopFile
-	stopPos := mysql_flashback.StopPosition
-	stopTime := mysql_flashback.StopTime
-	gtidRegexp := mysql_flashback.GtidRegexp
-	database := mysql_flashback.Database
-	onlyTable := mysql_flashback.OnlyTablesList
-	onlySqlType := mysql_flashback.OnlySqlTypeList
-	onlyDML := mysql_flashback.OnlyDML
-	filterTx := mysql_flashback.FilterTx
-	output := mysql_flashback.OutputFile
-	flashback := mysql_flashback.Rollback
+	cfg := mysql_flashback.DefaultConfig()
+	cfg.MysqlUri = "root:root@tcp(127.0.0.1:3306)/test"
+	cfg.Database = "test"
+	cfg.OnlyTables = []string{"user"}
+	cfg.StartFile = "/var/lib/mysql/mysql-bin.000001"
+	cfg.StartPos = 4
+	cfg.OutputFile = "rollback.sql"
+	cfg.Rollback = true
 
-	fb := mysql_flashback.NewFlashback(
-		mysqlUri, startLog, uint32(startPos), startTime,
-		stopLog, uint32(stopPos), stopTime, gtidRegexp,
-		database, onlyTable, onlySqlType, onlyDML,
-		filterTx, output, flashback,
-	)
-	err := fb.Flashback(mysqlUri, startLog, uint32(startPos))
+	fb, err := mysql_flashback.NewFlashback(cfg)
 	if err != nil {
 		log.Fatal(errors.ErrorStack(err))
 	}
+	defer fb.Close()
+	if err := fb.Flashback(); err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
 }
@@ -0,0 +1,163 @@
+package mysql_flashback
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// 库名或表名的匹配规则:
+//   - /regexp/ 为正则表达式, 需要完整匹配. 表的正则匹配 schema.table
+//   - 其他为glob(*, ?, [a-z]), 表可以写成 schema.table 或只写 table(匹配任意库)
+type namePattern struct {
+	schema string // glob, 为空则匹配任意库
+	name   string // glob
+	re     *regexp.Regexp
+}
+
+func parseNamePattern(pattern string, qualified bool) (*namePattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, errors.Annotatef(err, "pattern: %s", pattern)
+		}
+		return &namePattern{re: re}, nil
+	}
+
+	p := &namePattern{name: pattern}
+	if idx := strings.Index(pattern, "."); qualified && idx != -1 {
+		p.schema, p.name = pattern[:idx], pattern[idx+1:]
+	}
+	for _, glob := range []string{p.schema, p.name} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("pattern is illegal: %s", pattern)
+		}
+	}
+	return p, nil
+}
+
+func (p *namePattern) match(schema, name string) bool {
+	if p.re != nil {
+		if schema == "" {
+			return p.re.MatchString(name)
+		}
+		return p.re.MatchString(schema + "." + name)
+	}
+	if p.schema != "" {
+		if ok, _ := path.Match(p.schema, schema); !ok {
+			return false
+		}
+	}
+	ok, _ := path.Match(p.name, name)
+	return ok
+}
+
+func parseNamePatterns(patterns []string, qualified bool) ([]*namePattern, error) {
+	var res []*namePattern
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		p, err := parseNamePattern(pattern, qualified)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*namePattern, schema, name string) bool {
+	for _, p := range patterns {
+		if p.match(schema, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 库和表的过滤, exclude优先于include. include为空则不限制
+type tableFilter struct {
+	includeSchemas []*namePattern
+	excludeSchemas []*namePattern
+	includeTables  []*namePattern
+	excludeTables  []*namePattern
+	parser         *parser.Parser
+}
+
+func newTableFilter(includeSchemas, excludeSchemas, includeTables, excludeTables []string) (*tableFilter, error) {
+	f := &tableFilter{parser: parser.New()}
+	var err error
+	if f.includeSchemas, err = parseNamePatterns(includeSchemas, false); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.excludeSchemas, err = parseNamePatterns(excludeSchemas, false); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.includeTables, err = parseNamePatterns(includeTables, true); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.excludeTables, err = parseNamePatterns(excludeTables, true); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+func (f *tableFilter) matchSchema(schema string) bool {
+	if matchAny(f.excludeSchemas, "", schema) {
+		return false
+	}
+	return len(f.includeSchemas) == 0 || matchAny(f.includeSchemas, "", schema)
+}
+
+func (f *tableFilter) match(schema, table string) bool {
+	if !f.matchSchema(schema) || matchAny(f.excludeTables, schema, table) {
+		return false
+	}
+	return len(f.includeTables) == 0 || matchAny(f.includeTables, schema, table)
+}
+
+// DDL按其中的表过滤, 有一个表匹配即保留. 其他语句(或无法解析的DDL)按默认库过滤
+func (f *tableFilter) matchQuery(defaultSchema, query string) bool {
+	if isTxQuery(query) || !isDDL(query) {
+		return f.matchSchema(defaultSchema)
+	}
+	stmts, _, err := f.parser.Parse(query, "", "")
+	if err != nil {
+		return f.matchSchema(defaultSchema)
+	}
+
+	collector := &tableNameCollector{}
+	for _, stmt := range stmts {
+		stmt.Accept(collector)
+	}
+	if len(collector.names) == 0 {
+		return f.matchSchema(defaultSchema)
+	}
+	for _, name := range collector.names {
+		if schema, table := tableNameOf(name, defaultSchema); f.match(schema, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// 收集语句中所有的表名
+type tableNameCollector struct {
+	names []*ast.TableName
+}
+
+func (c *tableNameCollector) Enter(n ast.Node) (ast.Node, bool) {
+	if name, ok := n.(*ast.TableName); ok {
+		c.names = append(c.names, name)
+	}
+	return n, false
+}
+
+func (c *tableNameCollector) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
@@ -0,0 +1,63 @@
+package mysql_flashback
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNamePattern(t *testing.T) {
+	// 名字的格式为 schema.table, 库名的模式没有schema部分
+	tests := []struct {
+		pattern   string
+		qualified bool
+		match     []string
+		mismatch  []string
+	}{
+		{pattern: "order", match: []string{"shop.order"}, mismatch: []string{"shop.orders", "shop.Order"}},
+		{pattern: "order_*", match: []string{"shop.order_item", "shop.order_"}, mismatch: []string{"shop.order"}},
+		{pattern: "order_?", match: []string{"shop.order_1"}, mismatch: []string{"shop.order_12"}},
+		{pattern: "order_[0-9]", match: []string{"shop.order_5"}, mismatch: []string{"shop.order_a"}},
+		{pattern: "shop.order", qualified: true, match: []string{"shop.order"}, mismatch: []string{"bak.order"}},
+		{pattern: "*.order", qualified: true, match: []string{"shop.order", "bak.order"}, mismatch: []string{"shop.item"}},
+		{pattern: "order", qualified: true, match: []string{"shop.order", "bak.order"}},
+		{pattern: "/order_[0-9]+/", match: []string{".order_12"}, mismatch: []string{".order_x"}},
+		// 正则匹配 schema.table 的全部
+		{pattern: "/shop\\.order_.*/", qualified: true, match: []string{"shop.order_item"}, mismatch: []string{"bak.order_item"}},
+		{pattern: "/order/", qualified: true, mismatch: []string{"shop.order"}},
+	}
+	for _, tt := range tests {
+		p, err := parseNamePattern(tt.pattern, tt.qualified)
+		if err != nil {
+			t.Fatalf("parseNamePattern(%q) error = %v", tt.pattern, err)
+		}
+		for _, name := range tt.match {
+			schema, table, _ := strings.Cut(name, ".")
+			if !p.match(schema, table) {
+				t.Errorf("%q does not match %s", tt.pattern, name)
+			}
+		}
+		for _, name := range tt.mismatch {
+			schema, table, _ := strings.Cut(name, ".")
+			if p.match(schema, table) {
+				t.Errorf("%q matches %s", tt.pattern, name)
+			}
+		}
+	}
+
+	// 不是qualified时整个模式都是名字, 其中的.不作为分隔符
+	p, err := parseNamePattern("shop.order", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.match("shop", "shop.order") || p.match("shop", "order") {
+		t.Errorf("unqualified %q should only match the name itself", "shop.order")
+	}
+}
+
+func TestParseNamePatternIllegal(t *testing.T) {
+	for _, pattern := range []string{"order_[", "shop[.order", "/order_(/"} {
+		if _, err := parseNamePattern(pattern, true); err == nil {
+			t.Errorf("parseNamePattern(%q) error = nil, want error", pattern)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package mysql_flashback
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
 	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
-	"reflect"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -20,6 +26,17 @@ const (
 	SqlBeginFormat  = "/* BEGIN -> %s | binlog: %s | pos: (%d, %d) | time: %s */"
 	SqlCommitFormat = "/* COMMIT -> %s | binlog: %s | pos: (%d, %d) | time: %s */\n"
 
+	// binlog中的TIMESTAMP按UTC输出, 执行前需要把会话的时区设置为UTC
+	SqlTimeZone = "SET time_zone='+00:00';"
+
+	// rollback模式下每个事务的首尾. 文件倒序后BEGIN在前, COMMIT在后
+	SqlRollbackBeginFormat = "BEGIN; /* ROLLBACK -> %s | binlog: %s | pos: (%d, %d) | time: %s */"
+	SqlRollbackCommit      = "\nCOMMIT;"
+	// 解析在事务中间结束(如stop-pos、stop-time)时, 不完整的事务从BEGIN到COMMIT整个注释掉, 不能执行
+	SqlComment               = "-- "
+	SqlIncompleteBegin       = SqlComment + "BEGIN;"
+	SqlIncompleteBeginFormat = SqlComment + SqlRollbackBeginFormat
+
 	SqlInsertFormat = "INSERT INTO `%s`.`%s`(%s) VALUES (%s);"
 	SqlUpdateFormat = "UPDATE `%s`.`%s` SET %s WHERE %s LIMIT 1;"
 	SqlDeleteFormat = "DELETE FROM `%s`.`%s` WHERE %s LIMIT 1;"
@@ -32,6 +49,10 @@ const (
 
 type Flashback struct {
 	mysqlUri string
+	remote   bool   // 通过复制协议从服务端拉取binlog
+	serverID uint32 // 远程模式下伪装成slave使用的server id
+	offline  bool   // 不连接数据库, 表结构来自schema-file或binlog
+	dbm      *DBMap
 
 	// filter binlog args
 	startFile string
@@ -42,9 +63,13 @@ type Flashback struct {
 	stopTime  uint32
 
 	// filter event args
-	database    string
 	gtidRegexp  *regexp.Regexp
-	onlyTables  map[string]struct{}                // map[tableName]struct{}
+	gtidFilter  *gtidFilter                        // include/exclude gtid set
+	txSelector  *txSelector                        // 只解析指定的事务
+	dependents  *txSelector                        // cascade时依赖回滚范围的事务
+	pastRange   bool                               // 已经超出回滚范围, 只解析dependents
+	tableFilter *tableFilter                       // 库和表的include/exclude
+	rowFilter   *rowFilter                         // 行的过滤条件
 	onlySqlType map[replication.EventType]struct{} // INSERT, UPDATE, DELETE
 	filterTx    bool                               // filter Transaction event
 	onlyDML     bool                               // ignore ddl
@@ -52,67 +77,221 @@ type Flashback struct {
 	// output args
 	outputFile string
 	flashback  bool
+	useKey     bool         // UPDATE/DELETE的WHERE只使用主键(或唯一键)
+	minimal    bool         // UPDATE的SET只包含修改过的字段
+	format     string       // sql, jsonl, csv, debezium, canal
+	formatter  rowFormatter // 按行输出的非sql格式
+	columns    *columnRules // 输出中去掉、脱敏的列
+
+	removePartial   bool // 被取消时删除输出文件
+	discard         bool // 删除输出文件, 如被取消或存在冲突
+	conflictPolicy  string
+	conflicts       []*Conflict
+	verify          bool
+	verifyOnly      bool // 只校验, 不输出
+	verifySummaries []*VerifySummary
+	applyDSN        string
+	applyMismatch   string
+	applyReport     string
+	applyResult     *ApplyResult
+	interrupted     bool           // 解析被ctx取消
+	position        BinlogPosition // 最后处理的event
 
 	// assist field
 	allLogs           map[string]int        // map[filePath]index
 	gtidEventType     replication.EventType // QUERY when gtid mode on, otherwise ANONYMOUS_GTID
 	gtidEventStartPos uint32                // fix CUD event's start pos
+	gtidSID           uuid.UUID             // 当前事务的gtid, 没有开启gtid时为空
+	gtidGNO           int64
+	gtid              string
+	skipTx            bool         // 当前事务被gtid过滤
+	dependentTx       bool         // 当前事务是cascade时依赖回滚范围的事务
+	txRows            int          // rollback模式下当前事务已输出的sql数量
+	txTime            uint32       // rollback模式下当前事务最后一条sql的时间
+	txChanges         []*RowChange // jsonl、csv模式下当前事务的变更
 	outputChan        chan string
-	exitChan          chan struct{}
+	changeChan        chan *RowChange // csv模式下的输出
+	csv               *csvOutput
+	exitChan          chan error    // output()的结果
+	outputFailed      chan struct{} // output()写入失败时关闭, 解析随之中止
+	writer            io.Writer
+	file              *os.File
 }
 
-func NewFlashback(
-	mysqlUri string, startFile string, startPos uint32, startTime string,
-	stopFile string, stopPos uint32, stopTime string, gtidRegexp string,
-	database string, onlyTables []string, onlySqlType []string, onlyDML bool,
-	filterTx bool, outputFile string, flashback bool,
-) *Flashback {
-	if startFile == "" {
-		panic("err: start File must exist")
+func NewFlashback(cfg *Config) (_ *Flashback, err error) {
+	if cfg.StartFile == "" {
+		return nil, errors.New("start file must exist")
 	}
-	if stopFile == "" && stopPos != 0 {
-		panic("err: stopFile is empty but stopPos not")
+	if cfg.StopFile == "" && cfg.StopPos != 0 {
+		return nil, errors.New("stop file is empty but stop pos not")
 	}
 
 	var startT, stopT uint32
-	if startTime != "" {
-		start, err := time.ParseInLocation(layout, startTime, time.Local)
+	if cfg.StartTime != "" {
+		start, err := time.ParseInLocation(layout, cfg.StartTime, time.Local)
 		if err != nil {
-			panic("start time format is illegal")
+			return nil, errors.Annotate(err, "start time format is illegal")
 		}
 		startT = uint32(start.Unix())
 	}
-	if stopTime != "" {
-		stop, err := time.ParseInLocation(layout, stopTime, time.Local)
+	if cfg.StopTime != "" {
+		stop, err := time.ParseInLocation(layout, cfg.StopTime, time.Local)
 		if err != nil {
-			panic("start time format is illegal")
+			return nil, errors.Annotate(err, "stop time format is illegal")
 		}
 		stopT = uint32(stop.Unix())
 	}
 
 	var GTIDRegexp *regexp.Regexp
-	if len(gtidRegexp) != 0 {
-		GTIDRegexp = regexp.MustCompile(gtidRegexp)
+	if len(cfg.GtidRegexp) != 0 {
+		var err error
+		GTIDRegexp, err = regexp.Compile(cfg.GtidRegexp)
+		if err != nil {
+			return nil, errors.Annotate(err, "gtid regexp is illegal")
+		}
 	}
-
-	dbm, err := LinkDB(mysqlUri)
+	gtidFilter, err := newGtidFilter(cfg.IncludeGtids, cfg.ExcludeGtids)
 	if err != nil {
-		panic(err)
+		return nil, errors.Trace(err)
+	}
+	txSelector, err := newTxSelector(cfg.Transactions)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch cfg.ApplyOnMismatch {
+	case "", ApplyStop, ApplySkip:
+	default:
+		return nil, fmt.Errorf("apply mismatch policy is illegal: %s", cfg.ApplyOnMismatch)
+	}
+	format := cfg.Format
+	if format == "" {
+		format = FormatSQL
+	}
+	switch format {
+	case FormatSQL, FormatJSONL, FormatDebezium, FormatCanal:
+	case FormatCSV:
+		if cfg.OutputFile == "" || cfg.OutputFile == stdout {
+			return nil, errors.New("csv format needs an output directory")
+		}
+	default:
+		return nil, fmt.Errorf("output format is illegal: %s", cfg.Format)
+	}
+	verify := cfg.Verify || cfg.VerifyOnly
+	// 只校验时ApplyDSN只作为校验的数据库
+	if cfg.ApplyDSN != "" && !cfg.VerifyOnly {
+		if format != FormatSQL {
+			return nil, errors.New("apply needs sql format")
+		}
+		if !cfg.Rollback {
+			return nil, errors.New("apply needs rollback mode")
+		}
+	}
+	if cfg.ApplyDSN != "" {
+		if _, err := driver.ParseDSN(cfg.ApplyDSN); err != nil {
+			return nil, errors.Annotate(err, "apply dsn")
+		}
+	}
+	if verify && cfg.ApplyDSN == "" && (cfg.Offline || (cfg.SchemaFile != "" && !cfg.Remote)) {
+		return nil, errors.New("verify needs database connection in offline mode, use apply dsn")
+	}
+	// 数据库当前的表结构已经包含了之后的DDL, 以它为起点重放会重复应用
+	if cfg.SchemaHistory && cfg.SchemaFile == "" {
+		return nil, errors.New("schema history needs schema file taken at start file")
+	}
+	switch cfg.Conflict {
+	case "", ConflictReport, ConflictAbort, ConflictCascade:
+	default:
+		return nil, fmt.Errorf("conflict policy is illegal: %s", cfg.Conflict)
+	}
+
+	// 指定了SchemaFile时进入离线模式, 不需要连接数据库.
+	// 没有SchemaFile的离线模式要求binlog_row_metadata=FULL, 表结构全部来自TABLE_MAP_EVENT
+	if cfg.Remote && cfg.Offline {
+		return nil, errors.New("offline mode can not be used with remote mode")
+	}
+	offline := cfg.Offline || (cfg.SchemaFile != "" && !cfg.Remote)
+
+	var dbm *DBMap
+	if offline {
+		dbm = NewOfflineDBMap(NewSchemaSnapshot())
+	} else {
+		dbm, err = LinkDB(cfg.MysqlUri)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	defer func() {
+		if err != nil {
+			dbm.Close()
+		}
+	}()
+	if cfg.SchemaFile != "" {
+		snapshot, err := LoadSchemaFile(cfg.SchemaFile, cfg.Database)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		dbm.provider = snapshot
+	}
+	// 以SchemaFile为起点重放DDL
+	if cfg.SchemaHistory {
+		dbm.EnableSchemaHistory()
+	}
+
+	stopFile := cfg.StopFile
+	var logs []*BinlogInfo
+	switch {
+	case offline:
+		logs, err = filterLocalBinlog(cfg.StartFile, 0)
+	case cfg.Remote:
+		// 远程模式下只使用binlog的文件名
+		if stopFile != "" {
+			stopFile = path.Base(stopFile)
+		}
+		logs, err = filterRemoteBinlog(dbm, cfg.StartFile, 0)
+	default:
+		logs, err = filterBinlog(dbm, cfg.StartFile, 0)
 	}
-	logs, err := filterBinlog(dbm, startFile, 0)
 	if err != nil {
-		panic(err)
+		return nil, errors.Trace(err)
+	}
+	// 本地模式下stopFile与startFile在同一目录, 只填写文件名也可以
+	if stopFile != "" && !cfg.Remote {
+		stopFile = path.Join(path.Dir(cfg.StartFile), path.Base(stopFile))
 	}
 	allLogs := make(map[string]int, len(logs))
 	for idx, log := range logs {
 		allLogs[log.path] = idx
 	}
+	if _, ok := allLogs[stopFile]; stopFile != "" && !ok {
+		return nil, fmt.Errorf("%w: stop file %s is not after start file %s", ErrBinlogNotFound, stopFile, cfg.StartFile)
+	}
 
-	tables := make(map[string]struct{}, len(onlyTables))
-	for _, table := range onlyTables {
-		tables[table] = struct{}{}
+	includeSchemas := cfg.Databases
+	if cfg.Database != "" {
+		includeSchemas = append([]string{cfg.Database}, includeSchemas...)
+	}
+	tableFilter, err := newTableFilter(includeSchemas, cfg.ExcludeDatabases, cfg.OnlyTables, cfg.ExcludeTables)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rowFilter, err := newRowFilter(cfg.Where)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// 脱敏后的回滚sql会把错误的值写回数据库
+	if len(cfg.MaskColumns) != 0 && cfg.Rollback {
+		return nil, errors.New("mask columns can not be used with rollback")
+	}
+	// 去掉列后的回滚sql不完整: INSERT缺少列, WHERE可能匹配到其他行
+	if len(cfg.ExcludeColumns) != 0 && (cfg.Rollback || cfg.ApplyDSN != "") {
+		return nil, errors.New("exclude columns can not be used with rollback or apply dsn")
+	}
+	columns, err := newColumnRules(cfg.ExcludeColumns, cfg.MaskColumns)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
+	onlySqlType := cfg.OnlySqlType
 	if len(onlySqlType) == 0 {
 		onlySqlType = []string{"INSERT", "UPDATE", "DELETE"}
 	}
@@ -131,115 +310,334 @@ func NewFlashback(
 		}
 	}
 
-	gitdModeOn, err := getGitdModeFromDb(dbm.db)
-	if err != nil {
-		panic(err)
-	}
+	// 离线模式下无法查询gtid mode, 解析到GTID_EVENT时再修正
 	gitdEventType := replication.ANONYMOUS_GTID_EVENT
-	if gitdModeOn {
-		gitdEventType = replication.QUERY_EVENT
+	if !offline {
+		gitdModeOn, err := getGitdModeFromDb(dbm.db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if gitdModeOn {
+			gitdEventType = replication.QUERY_EVENT
+		}
+		// 只是当前的设置, 要解析的binlog可能是修改设置之前写入的, 以event中的记录为准
+		rowImage, err := getBinlogRowImageFromDb(dbm.db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if rowImage != "FULL" && cfg.Rollback {
+			log.Warnf("binlog_row_image is %s, rollback of UPDATE/DELETE whose before image misses columns will fail", rowImage)
+		}
 	}
 
+	outputFile := cfg.OutputFile
 	if outputFile == "" {
 		outputFile = stdout
 	}
 
 	// 使用flashback功能将自动修改以下属性
-	if flashback {
+	filterTx, onlyDML := cfg.FilterTx, cfg.OnlyDML
+	if cfg.Rollback {
 		filterTx = true
 		onlyDML = true
 	}
 
 	fb := &Flashback{
-		mysqlUri:      mysqlUri,
-		startFile:     startFile,
-		startPos:      startPos,
-		startTime:     startT,
-		stopFile:      stopFile,
-		stopPos:       stopPos,
-		stopTime:      stopT,
-		gtidRegexp:    GTIDRegexp,
-		database:      database,
-		onlyTables:    tables,
-		onlySqlType:   types,
-		filterTx:      filterTx,
-		onlyDML:       onlyDML,
-		outputFile:    outputFile,
-		flashback:     flashback,
-		allLogs:       allLogs,
-		gtidEventType: gitdEventType,
-		outputChan:    make(chan string, 2<<10),
-		exitChan:      make(chan struct{}, 1),
-	}
-	go fb.output()
-	return fb
-}
-
-func (fb *Flashback) Flashback(mysqlUri string, binlog string, position uint32) error {
-	err := BinlogStream(mysqlUri, binlog, position, fb.flashbackFunc)
+		mysqlUri:       cfg.MysqlUri,
+		remote:         cfg.Remote,
+		serverID:       cfg.ServerID,
+		offline:        offline,
+		dbm:            dbm,
+		startFile:      cfg.StartFile,
+		startPos:       cfg.StartPos,
+		startTime:      startT,
+		stopFile:       stopFile,
+		stopPos:        cfg.StopPos,
+		stopTime:       stopT,
+		gtidRegexp:     GTIDRegexp,
+		gtidFilter:     gtidFilter,
+		txSelector:     txSelector,
+		tableFilter:    tableFilter,
+		rowFilter:      rowFilter,
+		onlySqlType:    types,
+		filterTx:       filterTx,
+		onlyDML:        onlyDML,
+		outputFile:     outputFile,
+		flashback:      cfg.Rollback,
+		useKey:         cfg.UseKey,
+		minimal:        cfg.MinimalUpdate,
+		removePartial:  cfg.RemovePartial,
+		conflictPolicy: cfg.Conflict,
+		format:         format,
+		formatter:      newRowFormatter(format),
+		columns:        columns,
+		verify:         verify,
+		verifyOnly:     cfg.VerifyOnly,
+		applyDSN:       cfg.ApplyDSN,
+		applyMismatch:  cfg.ApplyOnMismatch,
+		applyReport:    cfg.ApplyReport,
+		allLogs:        allLogs,
+		gtidEventType:  gitdEventType,
+		outputChan:     make(chan string, 2<<10),
+		changeChan:     make(chan *RowChange, 2<<10),
+		exitChan:       make(chan error, 1),
+		outputFailed:   make(chan struct{}),
+	}
+	if fb.verifyOnly {
+		return fb, nil
+	}
+	if err := fb.openOutput(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if fb.csv != nil {
+		go fb.outputCSV()
+	} else {
+		go fb.output()
+	}
+	return fb, nil
+}
+
+// 关闭数据库连接, 解析结束后调用
+func (fb *Flashback) Close() error {
+	return errors.Trace(fb.dbm.Close())
+}
+
+// 从StartFile的StartPos开始解析
+func (fb *Flashback) Flashback() error {
+	return fb.FlashbackContext(context.Background())
+}
+
+// ctx取消时在下一个event处停止解析, 并把已经生成的sql写完.
+// 之后按RemovePartial删除输出文件, 或保留(rollback模式下完成倒序), 返回的错误包装了ctx.Err().
+// Transactions中有xid, 开启Conflict、Verify时先扫描binlog找到xid的事务, 检查冲突, 校验当前的行.
+// VerifyOnly时只校验, 不输出
+func (fb *Flashback) FlashbackContext(ctx context.Context) error {
+	if fb.verifyOnly {
+		return errors.Trace(fb.verifyContext(ctx))
+	}
+	err := fb.resolveXids(ctx)
+	if err == nil && fb.conflictPolicy != "" {
+		err = fb.checkConflicts(ctx)
+	}
+	if err == nil && fb.verify {
+		err = fb.checkRows(ctx)
+	}
+	if err == nil {
+		err = fb.stream(ctx, fb.dbm, fb.flashbackFunc)
+	} else {
+		fb.discard = true
+	}
+	if err != nil && ctx.Err() != nil {
+		fb.interrupted = true
+		fb.discard = fb.discard || fb.removePartial
+	}
+	// 缺少一部分事务的回滚文件不能执行
+	if errors.Is(err, ErrIncompleteRowImage) {
+		fb.discard = true
+	}
+	// 在事务中间结束解析(如stop-pos、stop-time), 事务也要完整地输出BEGIN
+	if endErr := fb.endTx(fb.position.File, fb.position.Pos, fb.txTime, txIncomplete, 0); endErr != nil && err == nil {
+		err = endErr
+	}
 	close(fb.outputChan)
-	<-fb.exitChan
+	close(fb.changeChan)
+	outputErr := <-fb.exitChan
+	// 写入失败时解析以StopError结束, 此时err为nil
+	if outputErr != nil {
+		return errors.Trace(outputErr)
+	}
+	if fb.txSelector != nil && !fb.interrupted && err == nil {
+		if missing := fb.txSelector.missing(); len(missing) != 0 {
+			return fmt.Errorf("%w: %s", ErrTransactionNotFound, strings.Join(missing, ", "))
+		}
+	}
+	if fb.interrupted {
+		return fmt.Errorf("%w: stopped after %s:%d, %s", ctx.Err(), fb.position.File, fb.position.Pos, fb.partialStatus())
+	}
+	if err == nil && fb.applyDSN != "" {
+		err = fb.apply(ctx)
+	}
+	return errors.Trace(err)
+}
+
+// xid在事务的最后(XID_EVENT), 解析到事务开始时还不知道是否选中. 先扫描一遍binlog, 把xid换成事务开始的位置
+func (fb *Flashback) resolveXids(ctx context.Context) error {
+	if fb.txSelector == nil || len(fb.txSelector.xids) == 0 {
+		return nil
+	}
+	var start BinlogPosition
+	err := fb.stream(ctx, fb.dbm.fork(), func(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+		if fb.afterRange(binlog, e) {
+			return StopError
+		}
+		switch e.Header.EventType {
+		case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT:
+			start = BinlogPosition{File: binlog.name, Pos: e.Header.LogPos - e.Header.EventSize}
+		case replication.XID_EVENT:
+			fb.txSelector.resolveXid(e.Event.(*replication.XIDEvent).XID, start)
+			if len(fb.txSelector.xids) == 0 {
+				return StopError
+			}
+		}
+		return nil
+	})
 	return errors.Trace(err)
 }
 
+// e在stop-time、stop-file、stop-pos之后
+func (fb *Flashback) afterRange(binlog *BinlogInfo, e *replication.BinlogEvent) bool {
+	if fb.stopTime != 0 && e.Header.Timestamp > fb.stopTime {
+		return true
+	}
+	if fb.stopFile == "" {
+		return false
+	}
+	if fb.stopPos != 0 && binlog.path == fb.stopFile && e.Header.LogPos > fb.stopPos {
+		return true
+	}
+	logIdx, ok := fb.allLogs[binlog.path]
+	return !ok || logIdx > fb.allLogs[fb.stopFile]
+}
+
+// 在ApplyDSN上执行生成的回滚文件, 并输出执行报告
+func (fb *Flashback) apply(ctx context.Context) error {
+	reportFile := fb.applyReport
+	if reportFile == "" {
+		reportFile = fb.outputFile + ".report"
+	}
+	report, err := os.OpenFile(reportFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer report.Close()
+
+	applier, err := NewApplier(fb.applyDSN, fb.applyMismatch, report)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer applier.Close()
+
+	err = applier.ApplyFile(ctx, fb.outputFile)
+	result := applier.Result()
+	fb.applyResult = &result
+	fmt.Fprintf(report, "%s\n", &result)
+	log.Infof("apply %s: %s, report: %s", fb.outputFile, &result, reportFile)
+	return errors.Trace(err)
+}
+
+// ApplyDSN上的执行结果, 没有执行时为nil
+func (fb *Flashback) ApplyResult() *ApplyResult {
+	return fb.applyResult
+}
+
+func (fb *Flashback) stream(ctx context.Context, dbm *DBMap, streamFunc SteamFunc) error {
+	if fb.remote {
+		return remoteBinlogStream(ctx, dbm, fb.mysqlUri, fb.serverID, fb.startFile, fb.startPos, fb.skipGtids(), streamFunc)
+	}
+	return localBinlogStream(ctx, dbm, fb.startFile, fb.startPos, streamFunc)
+}
+
+// 指定了include gtids时远程模式使用COM_BINLOG_DUMP_GTID, 否则返回nil.
+// 检查冲突需要回滚范围之后所有的事务(跳过的事务可能在回滚范围之后提交), 此时只跳过startFile之前的事务
+func (fb *Flashback) skipGtids() *mysql.MysqlGTIDSet {
+	skipped := fb.gtidFilter.skipped()
+	if skipped != nil && fb.conflictPolicy != "" {
+		return &mysql.MysqlGTIDSet{Sets: make(map[string]*mysql.UUIDSet)}
+	}
+	return skipped
+}
+
+func (fb *Flashback) partialStatus() string {
+	switch {
+	case fb.csv != nil && fb.discard:
+		return fmt.Sprintf("partial output removed from %s", fb.outputFile)
+	case fb.csv != nil:
+		return fmt.Sprintf("partial output kept in %s", fb.outputFile)
+	case fb.file == nil:
+		return "output written to stdout"
+	case fb.discard:
+		return fmt.Sprintf("partial output removed: %s", fb.outputFile)
+	case fb.flashback:
+		return fmt.Sprintf("partial rollback sql reversed in %s", fb.outputFile)
+	default:
+		return fmt.Sprintf("partial output kept in %s", fb.outputFile)
+	}
+}
+
 // err: nil/StopErr
 // 当e被过滤, return nil, nil
 // 当e没被过滤, return e, nil
 // 当中止解析时, return nil, StopErr
-func (fb *Flashback) filterEvent(binlog *BinlogInfo, e *replication.BinlogEvent) (event *replication.BinlogEvent, stopErr error) {
+func (fb *Flashback) filterEvent(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) (event *replication.BinlogEvent, stopErr error) {
+	if fb.pastRange {
+		return fb.filterDependent(dbm, binlog, e)
+	}
 	if fb.startTime != 0 && e.Header.Timestamp < fb.startTime {
 		return
 	}
 	if fb.stopTime != 0 && e.Header.Timestamp > fb.stopTime {
-		return nil, StopError
+		return fb.endRange(dbm, binlog, e)
 	}
 
-	// 只解析一个文件的情况
-	if fb.startFile == fb.stopFile && fb.startPos != 0 && e.Header.LogPos < fb.startPos {
+	// start-file中start-pos之前的event. 按文件名比较, start-file可能带有未规范化的路径
+	if fb.startPos != 0 && binlog.name == path.Base(fb.startFile) && e.Header.LogPos < fb.startPos {
 		return
 	}
 
 	if fb.stopFile != "" {
 		// 解析到结束位置的情况
 		if fb.stopPos != 0 && binlog.path == fb.stopFile && e.Header.LogPos > fb.stopPos {
-			return nil, StopError
+			return fb.endRange(dbm, binlog, e)
 		}
 
 		// 解析到结束文件的情况
 		if logIdx, ok := fb.allLogs[binlog.path]; !ok || logIdx > fb.allLogs[fb.stopFile] {
-			return nil, StopError
+			return fb.endRange(dbm, binlog, e)
 		}
 	}
 
-	if fb.gtidRegexp != nil && e.Header.EventType == replication.GTID_EVENT {
-		gtidEvent := e.Event.(*replication.GTIDEvent)
-		if ok := fb.gtidRegexp.Match(gtidEvent.SID); !ok {
-			return
+	// 按gtid过滤整个事务, 包括其中的TABLE_MAP、ROWS、XID等event
+	switch e.Header.EventType {
+	case replication.GTID_EVENT:
+		if fb.gtidFilter != nil && fb.gtidFilter.passed(fb.gtidSID, fb.gtidGNO) {
+			return fb.endRange(dbm, binlog, e)
 		}
+		if fb.txSelector != nil && fb.txSelector.done() {
+			return fb.endRange(dbm, binlog, e)
+		}
+		fb.skipTx = !fb.matchGtid() || !fb.selectTx(binlog, e)
+		fb.matchDependent(binlog, e)
+	case replication.ANONYMOUS_GTID_EVENT:
+		if fb.txSelector != nil && fb.txSelector.done() {
+			return fb.endRange(dbm, binlog, e)
+		}
+		fb.skipTx = (fb.gtidFilter != nil && !fb.gtidFilter.matchAnonymous()) || !fb.selectTx(binlog, e)
+		fb.matchDependent(binlog, e)
+	}
+	if fb.skipTx {
+		return
+	}
+	if fb.dependentTx {
+		return fb.filterDependentEvent(dbm, e), nil
 	}
 
 	switch e.Header.EventType {
 	case replication.QUERY_EVENT:
 		queryEvent := e.Event.(*replication.QueryEvent)
-		if ok := string(queryEvent.Schema) == fb.database; !ok {
+		if !fb.tableFilter.matchQuery(string(queryEvent.Schema), string(queryEvent.Query)) {
 			return
 		}
-		// len(queryEvent.Query) != 5: 优化一点性能
-		if fb.onlyDML && len(queryEvent.Query) != 5 && string(queryEvent.Query) != "BEGIN" {
+		// len(queryEvent.Query) > 6: 优化一点性能
+		if fb.onlyDML && (len(queryEvent.Query) > 6 || !isTxQuery(string(queryEvent.Query))) {
 			return
 		}
 	case replication.TABLE_MAP_EVENT:
 		tableMapEvent := e.Event.(*replication.TableMapEvent)
 		schema := string(tableMapEvent.Schema)
 		table := string(tableMapEvent.Table)
-		if ok := schema == fb.database; !ok {
+		if !fb.tableFilter.match(schema, table) {
 			return
 		}
-		if len(fb.onlyTables) != 0 {
-			if _, ok := fb.onlyTables[table]; !ok {
-				return
-			}
-		}
 
 	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2,
 		replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
@@ -248,25 +646,116 @@ func (fb *Flashback) filterEvent(binlog *BinlogInfo, e *replication.BinlogEvent)
 			return
 		}
 		rowsEvent := e.Event.(*replication.RowsEvent)
-		schema := string(rowsEvent.Table.Schema)
-		if ok := schema == fb.database; !ok {
+		if !fb.tableFilter.match(string(rowsEvent.Table.Schema), string(rowsEvent.Table.Table)) {
 			return
 		}
+		return fb.filterRows(dbm, e), nil
 	}
 	return e, nil
 }
 
-func (fb *Flashback) prepare(dbm *DBMap, e *replication.BinlogEvent) error {
+// 按sql类型和where过滤ROWS_EVENT中的行, 回滚范围内和依赖的事务相同
+func (fb *Flashback) filterRows(dbm *DBMap, e *replication.BinlogEvent) *replication.BinlogEvent {
+	if _, ok := fb.onlySqlType[e.Header.EventType]; !ok {
+		return nil
+	}
+	// 没有表结构时由后面的处理报错
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	if tableMetadata, ok := dbm.LookupTableMetadata(rowsEvent.TableID); ok && fb.rowFilter != nil {
+		return fb.rowFilter.filter(tableMetadata, e)
+	}
+	return e
+}
+
+// 回滚范围结束. cascade时继续解析依赖回滚范围的事务, 否则中止解析
+func (fb *Flashback) endRange(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) (*replication.BinlogEvent, error) {
+	if fb.dependents == nil || fb.dependents.done() {
+		return nil, StopError
+	}
+	fb.pastRange = true
+	fb.skipTx = true // 回滚范围在事务中间结束时, 事务剩下的部分不再解析
+	fb.dependentTx = false
+	return fb.filterDependent(dbm, binlog, e)
+}
+
+// 没有选中的事务依赖回滚范围时(cascade)同样回滚
+func (fb *Flashback) matchDependent(binlog *BinlogInfo, e *replication.BinlogEvent) {
+	fb.dependentTx = false
+	if fb.skipTx && fb.dependents != nil {
+		fb.skipTx = !fb.dependents.match(binlog, e, fb.gtid)
+		fb.dependentTx = !fb.skipTx
+	}
+}
+
+func (fb *Flashback) filterDependent(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) (*replication.BinlogEvent, error) {
 	switch e.Header.EventType {
-	// binlog本身不包含table field 数据,因此需要去数据库里拿
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT:
+		if fb.dependents.done() {
+			return nil, StopError
+		}
+		fb.skipTx = true
+		fb.matchDependent(binlog, e)
+	}
+	if fb.skipTx {
+		return nil, nil
+	}
+	return fb.filterDependentEvent(dbm, e), nil
+}
+
+// 依赖的事务要回滚对同一行的所有修改, 不按库、表过滤; sql类型和where与回滚范围内相同
+func (fb *Flashback) filterDependentEvent(dbm *DBMap, e *replication.BinlogEvent) *replication.BinlogEvent {
+	if isRowsEvent(e.Header.EventType) {
+		return fb.filterRows(dbm, e)
+	}
+	return e
+}
+
+// gtid-regexp匹配 uuid:gno 格式的gtid
+func (fb *Flashback) matchGtid() bool {
+	if fb.gtidRegexp != nil && !fb.gtidRegexp.MatchString(fb.gtid) {
+		return false
+	}
+	return fb.gtidFilter == nil || fb.gtidFilter.match(fb.gtidSID, fb.gtidGNO)
+}
+
+func (fb *Flashback) selectTx(binlog *BinlogInfo, e *replication.BinlogEvent) bool {
+	return fb.txSelector == nil || fb.txSelector.match(binlog, e, fb.gtid)
+}
+
+func (fb *Flashback) prepare(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+	// 不论是否被过滤, DDL都需要应用到表结构历史中
+	if e.Header.EventType == replication.QUERY_EVENT {
+		queryEvent := e.Event.(*replication.QueryEvent)
+		pos := BinlogPosition{File: binlog.name, Pos: e.Header.LogPos}
+		if err := dbm.ApplyDDL(pos, string(queryEvent.Schema), string(queryEvent.Query)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// 没有开启gtid时, 事务以ANONYMOUS_GTID_EVENT开头
+	if e.Header.EventType == replication.ANONYMOUS_GTID_EVENT {
+		fb.gtidSID, fb.gtidGNO, fb.gtid = uuid.UUID{}, 0, ""
+	}
+
+	switch e.Header.EventType {
+	// binlog_row_metadata不为FULL时binlog本身不包含table field 数据,因此需要去数据库里拿.
+	// 被过滤的表不需要表结构, 依赖的事务不按表过滤
 	case replication.TABLE_MAP_EVENT:
 		tableMapEvent := e.Event.(*replication.TableMapEvent)
-		tableId := tableMapEvent.TableID
-		schema := string(tableMapEvent.Schema)
-		table := string(tableMapEvent.Table)
-		if err := dbm.Add(tableId, schema, table); err != nil {
+		if !fb.dependentTx && !fb.tableFilter.match(string(tableMapEvent.Schema), string(tableMapEvent.Table)) {
+			break
+		}
+		if err := dbm.Add(tableMapEvent); err != nil {
+			return errors.Trace(err)
+		}
+	// 开启gtid时, 事务以GTID_EVENT开头
+	case replication.GTID_EVENT:
+		fb.gtidEventType = replication.QUERY_EVENT
+		sid, gtid, err := gtidOfEvent(e.Event.(*replication.GTIDEvent))
+		if err != nil {
 			return errors.Trace(err)
 		}
+		fb.gtidSID, fb.gtidGNO, fb.gtid = sid, e.Event.(*replication.GTIDEvent).GNO, gtid
 	// CUD操作是放在事务里的,因此这些event的start pos应该为:
 	//   - 若没开启gitd, 为anonymousGitdEvent的值
 	//   - 若开启gitd, 为QueryEvent的值
@@ -277,10 +766,26 @@ func (fb *Flashback) prepare(dbm *DBMap, e *replication.BinlogEvent) error {
 }
 
 func (fb *Flashback) flashbackFunc(dbm *DBMap, binlog *BinlogInfo, event *replication.BinlogEvent) (err error) {
-	if err = fb.prepare(dbm, event); err != nil {
+	// 进入新的binlog文件时重置文件内的状态
+	if binlog.name != fb.position.File {
+		if err = fb.endTx(fb.position.File, fb.position.Pos, fb.txTime, txIncomplete, 0); err != nil {
+			return errors.Trace(err)
+		}
+		fb.gtidEventStartPos = 0
+		fb.skipTx = false
+		fb.dependentTx = false
+	}
+	// 上一个事务没有XID_EVENT就开始了新的事务
+	if t := event.Header.EventType; t == replication.GTID_EVENT || t == replication.ANONYMOUS_GTID_EVENT {
+		if err = fb.endTx(fb.position.File, fb.position.Pos, fb.txTime, txIncomplete, 0); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	fb.position = BinlogPosition{File: binlog.name, Pos: event.Header.LogPos}
+	if err = fb.prepare(dbm, binlog, event); err != nil {
 		return errors.Trace(err)
 	}
-	event, err = fb.filterEvent(binlog, event)
+	event, err = fb.filterEvent(dbm, binlog, event)
 	if err != nil {
 		return StopError
 	}
@@ -288,13 +793,23 @@ func (fb *Flashback) flashbackFunc(dbm *DBMap, binlog *BinlogInfo, event *replic
 		return nil // 已经被过滤
 	}
 	if err = fb.outputSql(dbm, binlog, event); err != nil {
+		if err == StopError {
+			return StopError
+		}
 		return errors.Trace(err)
 	}
 	return nil
 }
 
 func (fb *Flashback) outputSql(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) (err error) {
-	var content string
+	// 写入失败时不再继续解析, 错误由Flashback()返回
+	select {
+	case <-fb.outputFailed:
+		return StopError
+	default:
+	}
+
+	var contents []string
 	var outputFormat string
 	startPos := e.Header.LogPos - e.Header.EventSize
 
@@ -305,25 +820,37 @@ func (fb *Flashback) outputSql(dbm *DBMap, binlog *BinlogInfo, e *replication.Bi
 		if query == "BEGIN" {
 			if !fb.filterTx {
 				outputFormat = SqlBeginFormat
-				content = "Transaction BEGIN"
+				contents = []string{"Transaction BEGIN"}
+			}
+		} else if query == "COMMIT" {
+			// 非事务引擎的事务以COMMIT结束, 没有XID_EVENT
+			if err := fb.endTx(binlog.name, e.Header.LogPos, e.Header.Timestamp, "COMMIT", 0); err != nil {
+				return errors.Trace(err)
+			}
+			if !fb.filterTx {
+				outputFormat = SqlCommitFormat
+				contents = []string{"Transaction COMMIT"}
 			}
 		} else {
 			outputFormat = SqlDDLFormat
-			content = query
+			contents = []string{query}
 		}
 
 	case replication.ANONYMOUS_GTID_EVENT:
 		if !fb.filterTx {
 			outputFormat = SqlGtidFormat
-			content = "Transaction Group"
+			contents = []string{"Transaction Group"}
 		}
 
 	case replication.XID_EVENT:
+		xidEvent := e.Event.(*replication.XIDEvent)
+		xId := xidEvent.XID
+		if err := fb.endTx(binlog.name, e.Header.LogPos, e.Header.Timestamp, fmt.Sprintf("xid: %d", xId), xId); err != nil {
+			return errors.Trace(err)
+		}
 		if !fb.filterTx {
 			outputFormat = SqlCommitFormat
-			xidEvent := e.Event.(*replication.XIDEvent)
-			xId := xidEvent.XID
-			content = fmt.Sprintf("Transaction COMMIT | xid: %d", xId)
+			contents = []string{fmt.Sprintf("Transaction COMMIT | xid: %d", xId)}
 		}
 
 	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2,
@@ -337,118 +864,183 @@ func (fb *Flashback) outputSql(dbm *DBMap, binlog *BinlogInfo, e *replication.Bi
 		tableId := rowsEvent.TableID
 		tableMetadata, ok := dbm.LookupTableMetadata(tableId)
 		if !ok {
-			return fmt.Errorf("search table error: %s:%d", rowsEvent.Table.Schema, tableId)
+			return fmt.Errorf("%w: %s.%s, table id: %d", ErrTableMetadataMissing, rowsEvent.Table.Schema, rowsEvent.Table.Table, tableId)
+		}
+		if fb.columns != nil {
+			tableMetadata, e = fb.columns.apply(tableMetadata, e)
+			rowsEvent = e.Event.(*replication.RowsEvent)
+		}
+		if fb.flashback {
+			if err := checkRollbackImage(tableMetadata, binlog, e); err != nil {
+				return errors.Trace(err)
+			}
 		}
 
+		if fb.format != FormatSQL {
+			for _, change := range newRowChanges(tableMetadata, e, fb.flashback) {
+				change.File, change.StartPos, change.GTID = binlog.name, startPos, fb.gtid
+				fb.txChanges = append(fb.txChanges, change)
+			}
+			return nil
+		}
+
+		// 一个event可能包含多行数据(如批量insert、范围update), 每行生成一条sql.
+		// rollback时整个文件会按行倒序, 因此event内的sql也会随之倒序
 		switch e.Header.EventType {
 		case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
 			if fb.flashback {
-				content = genDeleteSql(tableMetadata, rowsEvent)
+				contents = genDeleteSql(tableMetadata, rowsEvent, fb.useKey)
 			} else {
-				content = genInsertSql(tableMetadata, rowsEvent)
+				contents = genInsertSql(tableMetadata, rowsEvent)
 			}
 
 		case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
 			if fb.flashback {
-				content = genUpdateSql(tableMetadata, rowsEvent, true)
+				contents = genUpdateSql(tableMetadata, rowsEvent, true, fb.useKey, fb.minimal)
 			} else {
-				content = genUpdateSql(tableMetadata, rowsEvent, false)
+				contents = genUpdateSql(tableMetadata, rowsEvent, false, fb.useKey, fb.minimal)
 			}
 
 		case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
 			if fb.flashback {
-				content = genInsertSql(tableMetadata, rowsEvent)
+				contents = genInsertSql(tableMetadata, rowsEvent)
 			} else {
-				content = genDeleteSql(tableMetadata, rowsEvent)
+				contents = genDeleteSql(tableMetadata, rowsEvent, fb.useKey)
 			}
 		}
 	default:
 		return nil
 	}
 
-	if content == "" || outputFormat == "" {
+	if len(contents) == 0 || outputFormat == "" || fb.format != FormatSQL {
 		return nil
 	}
 
-	output := fmt.Sprintf(
-		outputFormat,
-		content,
-		binlog.name,
-		startPos,
-		e.Header.LogPos,
-		time.Unix(int64(e.Header.Timestamp), 0).Format(layout),
-	)
-	fb.outputChan <- output
+	if fb.flashback && outputFormat == SqlRowFormat {
+		fb.beginRollbackTx(e.Header.Timestamp, len(contents))
+	}
+
+	eventTime := time.Unix(int64(e.Header.Timestamp), 0).Format(layout)
+	for _, content := range contents {
+		output := fmt.Sprintf(
+			outputFormat,
+			content,
+			binlog.name,
+			startPos,
+			e.Header.LogPos,
+			eventTime,
+		)
+		fb.outputChan <- output
+	}
 	return nil
 }
 
-func (fb *Flashback) output() {
-	var writer io.Writer
-	var file *os.File
+// rollback模式下按原事务分组: 事务的第一条sql之前输出COMMIT, 事务结束时输出BEGIN.
+// 整个文件倒序后即为 BEGIN; 倒序的sql; COMMIT; 事务之间的顺序也随之倒序
+func (fb *Flashback) beginRollbackTx(timestamp uint32, n int) {
+	if fb.txRows == 0 {
+		fb.outputChan <- SqlRollbackCommit
+	}
+	fb.txRows += n
+	fb.txTime = timestamp
+}
+
+const txIncomplete = "incomplete transaction"
+
+// 事务结束: 输出jsonl模式下缓存的变更, rollback模式下输出BEGIN. 事务没有输出任何sql时(被过滤)不输出BEGIN
+func (fb *Flashback) endTx(binlog string, endPos uint32, timestamp uint32, status string, xid uint64) error {
+	if len(fb.txChanges) != 0 {
+		return errors.Trace(fb.flushRowChanges(xid))
+	}
+	if !fb.flashback || fb.txRows == 0 {
+		return nil
+	}
+	gtid := fb.gtid
+	if gtid == "" {
+		gtid = "ANONYMOUS"
+	}
+	content := fmt.Sprintf("Transaction ROLLBACK | gtid: %s | %s", gtid, status)
+	eventTime := time.Unix(int64(timestamp), 0).Format(layout)
+	format := SqlRollbackBeginFormat
+	if status == txIncomplete {
+		format = SqlIncompleteBeginFormat
+	}
+	fb.outputChan <- fmt.Sprintf(format, content, binlog, fb.gtidEventStartPos, endPos, eventTime)
+	fb.txRows = 0
+	return nil
+}
 
+func isTxQuery(query string) bool {
+	return query == "BEGIN" || query == "COMMIT"
+}
+
+func (fb *Flashback) openOutput() error {
+	if fb.format == FormatCSV {
+		output, err := newCSVOutput(fb.outputFile)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fb.csv = output
+		return nil
+	}
 	if fb.outputFile == stdout {
-		writer = os.Stdout
+		fb.writer = os.Stdout
 
 		// 因为要倒序生成,所以必须先输出到文件中
 		if fb.flashback {
-			fileName := fmt.Sprintf("rollback_%d.sql", time.Now().Unix())
-			file = MustOpen(fileName, os.O_TRUNC|os.O_CREATE|os.O_RDWR)
-			writer = io.MultiWriter(writer, file)
+			fileName := fmt.Sprintf("rollback_%d.%s", time.Now().Unix(), fb.format)
+			file, err := os.OpenFile(fileName, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			fb.file = file
+			fb.writer = io.MultiWriter(fb.writer, file)
 			fb.outputFile = fileName
 		}
-	} else {
-		file = MustOpen(fb.outputFile, os.O_TRUNC|os.O_CREATE|os.O_RDWR)
-		defer file.Close()
-		writer = file
+		return nil
 	}
 
-	for output := range fb.outputChan {
-		if _, err := fmt.Fprintln(writer, output); err != nil {
-			panic(err)
+	file, err := os.OpenFile(fb.outputFile, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fb.file = file
+	fb.writer = file
+	return nil
+}
+
+// 写入失败后关闭outputFailed并丢弃剩余的输出, 避免解析端阻塞
+func (fb *Flashback) output() {
+	var err error
+	if fb.format == FormatSQL {
+		if _, err = fmt.Fprintln(fb.writer, SqlTimeZone); err != nil {
+			err = errors.Trace(err)
+			close(fb.outputFailed)
 		}
 	}
-	if file != nil {
-		file.Close()
+	for output := range fb.outputChan {
+		if err != nil {
+			continue
+		}
+		if _, err = fmt.Fprintln(fb.writer, output); err != nil {
+			err = errors.Trace(err)
+			close(fb.outputFailed)
+		}
 	}
-	if fb.flashback {
-		reverseFile(fb.outputFile)
+	if fb.file != nil {
+		if closeErr := fb.file.Close(); closeErr != nil && err == nil {
+			err = errors.Trace(closeErr)
+		}
 	}
-
-	fb.exitChan <- struct{}{}
-}
-
-func buildSqlFieldValue(value interface{}) string {
-	if value == nil {
-		return "NULL"
+	switch {
+	case err != nil:
+	case fb.discard && fb.file != nil:
+		err = errors.Trace(os.Remove(fb.outputFile))
+	case fb.flashback:
+		err = reverseFile(fb.outputFile, fb.format == FormatSQL)
 	}
 
-	fieldType := reflect.TypeOf(value)
-	switch fieldType.Kind() {
-	case reflect.String:
-		return fmt.Sprintf("'%v'", value)
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return fmt.Sprintf("%v", value)
-	case reflect.Float32, reflect.Float64:
-		return fmt.Sprintf("%v", value)
-	case reflect.Bool:
-		return fmt.Sprintf("%v", value)
-		// text, longtext
-	case reflect.Slice:
-		s, ok := reflect.ValueOf(value).Interface().([]byte)
-		if !ok {
-			return fmt.Sprintf("---Invalid---: '%v'", value)
-		}
-		return fmt.Sprintf("'%s'", string(s))
-	case reflect.Uintptr, reflect.Complex64, reflect.Complex128, reflect.Array, reflect.Chan,
-		reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Struct,
-		reflect.UnsafePointer:
-		return fmt.Sprintf("---Invalid---: '%v'", value)
-	case reflect.Invalid:
-		return fmt.Sprintf("---Invalid---: '%v'", value)
-	default:
-		return fmt.Sprintf("---Invalid---: '%v'", value)
-	}
+	fb.exitChan <- err
 }
 
 func buildEqualExp(key, value string, inWhere bool) string {
@@ -460,22 +1052,91 @@ func buildEqualExp(key, value string, inWhere bool) string {
 	return fmt.Sprintf("`%s`=%s", key, value)
 }
 
-func buildSqlFieldsExp(mapIdxToFieldName map[int]string, fields []interface{}, inWhere bool) []string {
-	res := make([]string, len(fields))
+// 没有记录的列(binlog_row_image为MINIMAL/NOBLOB)不出现在sql中
+func buildSqlFieldsExp(tableMetadata *TableMetadata, fields []interface{}, present columnPresence, inWhere bool) []string {
+	res := make([]string, 0, len(fields))
 	for idx, field := range fields {
-		key := mapIdxToFieldName[idx]
-		value := buildSqlFieldValue(field)
-		res[idx] = buildEqualExp(key, value, inWhere)
+		if !present.has(idx) {
+			continue
+		}
+		key := tableMetadata.Fields[idx]
+		value := buildSqlFieldValue(field, tableMetadata.Columns[idx])
+		res = append(res, buildEqualExp(key, value, inWhere))
 	}
 	return res
 }
 
-func genInsertSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent) string {
-	fields := make([]string, len(rowsEvent.Rows[0]))
-	values := make([]string, len(rowsEvent.Rows[0]))
-	for idx, field := range rowsEvent.Rows[0] {
-		fields[idx] = fmt.Sprintf("`%s`", tableMetadata.Fields[idx])
-		values[idx] = buildSqlFieldValue(field)
+// 若开启useKey且表存在主键(或非空唯一键), WHERE只使用键字段, 否则使用全部字段
+func buildWhereExp(tableMetadata *TableMetadata, row []interface{}, present columnPresence, useKey bool) string {
+	if !useKey || len(tableMetadata.Keys) == 0 || !hasColumns(present, tableMetadata.Keys) {
+		return strings.Join(buildSqlFieldsExp(tableMetadata, row, present, true), " AND ")
+	}
+	res := make([]string, len(tableMetadata.Keys))
+	for i, idx := range tableMetadata.Keys {
+		value := buildSqlFieldValue(row[idx], tableMetadata.Columns[idx])
+		res[i] = buildEqualExp(tableMetadata.Fields[idx], value, true)
+	}
+	return strings.Join(res, " AND ")
+}
+
+func hasColumns(present columnPresence, fields []int) bool {
+	for _, idx := range fields {
+		if !present.has(idx) {
+			return false
+		}
+	}
+	return true
+}
+
+func genInsertSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent) []string {
+	res := make([]string, 0, len(rowsEvent.Rows))
+	for i := range rowsEvent.Rows {
+		row, present := rowAt(rowsEvent, i)
+		res = append(res, buildInsertSql(tableMetadata, row, present))
+	}
+	return res
+}
+
+// UPDATE_ROWS_EVENT中的Rows是成对出现的: Rows[2n]为before image, Rows[2n+1]为after image.
+// minimal时SET只包含修改过的字段, 没有修改的行不生成sql
+func genUpdateSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent, reverse bool, useKey bool, minimal bool) []string {
+	res := make([]string, 0, len(rowsEvent.Rows)/2)
+	for i := 0; i+1 < len(rowsEvent.Rows); i += 2 {
+		before, beforePresent := rowAt(rowsEvent, i)
+		after, afterPresent := rowAt(rowsEvent, i+1)
+		if reverse {
+			before, after = after, before
+			beforePresent, afterPresent = afterPresent, beforePresent
+		}
+		if !minimal {
+			res = append(res, buildUpdateSql(tableMetadata, before, beforePresent, after, afterPresent, useKey))
+			continue
+		}
+		if sql, ok := buildMinimalUpdateSql(tableMetadata, before, beforePresent, after, afterPresent, useKey); ok {
+			res = append(res, sql)
+		}
+	}
+	return res
+}
+
+func genDeleteSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent, useKey bool) []string {
+	res := make([]string, 0, len(rowsEvent.Rows))
+	for i := range rowsEvent.Rows {
+		row, present := rowAt(rowsEvent, i)
+		res = append(res, buildDeleteSql(tableMetadata, row, present, useKey))
+	}
+	return res
+}
+
+func buildInsertSql(tableMetadata *TableMetadata, row []interface{}, present columnPresence) string {
+	fields := make([]string, 0, len(row))
+	values := make([]string, 0, len(row))
+	for idx, field := range row {
+		if !present.has(idx) {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("`%s`", tableMetadata.Fields[idx]))
+		values = append(values, buildSqlFieldValue(field, tableMetadata.Columns[idx]))
 	}
 	content := fmt.Sprintf(
 		SqlInsertFormat,
@@ -487,83 +1148,142 @@ func genInsertSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent
 	return content
 }
 
-func genUpdateSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent, reverse bool) string {
-	idx1, idx2 := 0, 1
-	if reverse {
-		idx1, idx2 = idx2, idx1
-	}
-
-	whereFields := buildSqlFieldsExp(tableMetadata.Fields, rowsEvent.Rows[idx1], true)
-	setFields := buildSqlFieldsExp(tableMetadata.Fields, rowsEvent.Rows[idx2], false)
+func buildUpdateSql(tableMetadata *TableMetadata, before []interface{}, beforePresent columnPresence, after []interface{}, afterPresent columnPresence, useKey bool) string {
+	where := buildWhereExp(tableMetadata, before, beforePresent, useKey)
+	setFields := buildSqlFieldsExp(tableMetadata, after, afterPresent, false)
 	content := fmt.Sprintf(
 		SqlUpdateFormat,
 		tableMetadata.Schema,
 		tableMetadata.Table,
 		strings.Join(setFields, ", "),
-		strings.Join(whereFields, " AND "),
+		where,
 	)
 	return content
 }
 
-func genDeleteSql(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent) string {
-	fields := buildSqlFieldsExp(tableMetadata.Fields, rowsEvent.Rows[0], true)
+// SET只包含修改过的字段, WHERE与buildUpdateSql相同. 没有修改过的字段时ok为false
+func buildMinimalUpdateSql(tableMetadata *TableMetadata, before []interface{}, beforePresent columnPresence, after []interface{}, afterPresent columnPresence, useKey bool) (sql string, ok bool) {
+	var setFields []string
+	for idx, field := range after {
+		if !afterPresent.has(idx) {
+			continue
+		}
+		value := buildSqlFieldValue(field, tableMetadata.Columns[idx])
+		if idx < len(before) && beforePresent.has(idx) && buildSqlFieldValue(before[idx], tableMetadata.Columns[idx]) == value {
+			continue
+		}
+		setFields = append(setFields, buildEqualExp(tableMetadata.Fields[idx], value, false))
+	}
+	if len(setFields) == 0 {
+		return "", false
+	}
+	content := fmt.Sprintf(
+		SqlUpdateFormat,
+		tableMetadata.Schema,
+		tableMetadata.Table,
+		strings.Join(setFields, ", "),
+		buildWhereExp(tableMetadata, before, beforePresent, useKey),
+	)
+	return content, true
+}
+
+func buildDeleteSql(tableMetadata *TableMetadata, row []interface{}, present columnPresence, useKey bool) string {
+	where := buildWhereExp(tableMetadata, row, present, useKey)
 	content := fmt.Sprintf(
 		SqlDeleteFormat,
 		tableMetadata.Schema,
 		tableMetadata.Table,
-		strings.Join(fields, " AND "),
+		where,
 	)
 	return content
 }
 
-// flashback应该将sql逆序执行
-func reverseFile(file string) {
+// flashback应该将sql逆序执行. keepHeader时第一行(SET time_zone)保持在开头
+func reverseFile(file string, keepHeader bool) error {
 	tempName := file + ".temp"
 
-	originFile := MustOpen(file, os.O_RDONLY)
-	newFile := MustOpen(tempName, os.O_TRUNC|os.O_CREATE|os.O_RDWR)
+	originFile, err := os.OpenFile(file, os.O_RDONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	defer originFile.Close()
+	newFile, err := os.OpenFile(tempName, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	defer newFile.Close()
 
+	writer := &reversedWriter{file: newFile}
 	buff := &bytes.Buffer{}
 	char := make([]byte, 1)
 
-	stat, _ := originFile.Stat()
+	stat, err := originFile.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
 	filesize := stat.Size()
-
+	var headerSize int64
+	if keepHeader {
+		header, err := bufio.NewReader(originFile).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return errors.Trace(err)
+		}
+		if _, err := newFile.Write(header); err != nil {
+			return errors.Trace(err)
+		}
+		headerSize = int64(len(header))
+	}
+	// 文件以换行结束时跳过最后的换行, 倒序后每一行都以换行结束
 	var cursor int64 = 0
+	if filesize > headerSize {
+		if _, err := originFile.ReadAt(char, filesize-1); err != nil {
+			return errors.Trace(err)
+		}
+		if char[0] == '\n' {
+			cursor = -1
+		}
+	}
+	if filesize+cursor == headerSize {
+		return errors.Trace(os.Rename(tempName, file))
+	}
+
 	for {
 		cursor -= 1
 		if _, err := originFile.Seek(cursor, io.SeekEnd); err != nil {
-			panic(err)
+			return errors.Trace(err)
 		}
 		if _, err := originFile.Read(char); err != nil {
 			if err == io.EOF {
 				break
 			}
-			panic(err)
+			return errors.Trace(err)
 		}
 
 		buff.WriteByte(char[0])
 
 		if char[0] == '\n' {
 			if buff.Len() > 0 {
-				writerReversedBytes(newFile, buff.Bytes())
+				if err := writer.write(buff.Bytes()); err != nil {
+					return errors.Trace(err)
+				}
 			}
 			buff.Reset()
 		}
 
-		if cursor == -filesize {
+		if cursor == -(filesize - headerSize) {
 			if buff.Len() > 0 {
 				buff.WriteByte('\n')
-				writerReversedBytes(newFile, buff.Bytes())
+				if err := writer.write(buff.Bytes()); err != nil {
+					return errors.Trace(err)
+				}
 			}
 			break
 		}
 	}
-	if err := os.Rename(tempName, file); err != nil {
-		panic(err)
+	if err := newFile.Sync(); err != nil {
+		return errors.Trace(err)
 	}
+	return errors.Trace(os.Rename(tempName, file))
 }
 
 func reverse(s []byte) []byte {
@@ -575,17 +1295,25 @@ func reverse(s []byte) []byte {
 	return b.Bytes()
 }
 
-func writerReversedBytes(file *os.File, b []byte) {
-	data := reverse(b)
-	if _, err := file.Write(data); err != nil {
-		panic(err)
-	}
+// 按行写入倒序的结果. 不完整事务的BEGIN(已注释)之后到COMMIT的行也注释掉
+type reversedWriter struct {
+	file       *os.File
+	incomplete bool
 }
 
-func MustOpen(file string, flag int) *os.File {
-	f, err := os.OpenFile(file, flag, 0644)
-	if err != nil {
-		panic(err)
+func (w *reversedWriter) write(b []byte) error {
+	// b为倒序的一行及其之前的换行
+	line := bytes.TrimPrefix(reverse(b), []byte("\n"))
+	var data []byte
+	switch {
+	case bytes.HasPrefix(line, []byte(SqlIncompleteBegin)):
+		w.incomplete = true
+	case w.incomplete && len(bytes.TrimSpace(line)) != 0:
+		w.incomplete = !bytes.HasPrefix(line, []byte("COMMIT;"))
+		data = append(data, SqlComment...)
 	}
-	return f
+	data = append(data, line...)
+	data = append(data, '\n')
+	_, err := w.file.Write(data)
+	return errors.Trace(err)
 }
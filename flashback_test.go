@@ -0,0 +1,302 @@
+package mysql_flashback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestGenSqlPerRow(t *testing.T) {
+	rows := [][]interface{}{
+		{int32(1), "a", nil},
+		{int32(2), "it's", []byte("x")},
+		{int32(3), "c", nil},
+	}
+	insert := testRowsEvent(replication.WRITE_ROWS_EVENTv2, []byte{0x07}, nil, rows...)
+	wantInsert := []string{
+		"INSERT INTO `shop`.`t`(`id`, `name`, `content`) VALUES (1, 'a', NULL);",
+		"INSERT INTO `shop`.`t`(`id`, `name`, `content`) VALUES (2, 'it\\'s', X'78');",
+		"INSERT INTO `shop`.`t`(`id`, `name`, `content`) VALUES (3, 'c', NULL);",
+	}
+	if got := genInsertSql(testRowImageMetadata, insert.Event.(*replication.RowsEvent)); !reflect.DeepEqual(got, wantInsert) {
+		t.Errorf("genInsertSql() = %q, want %q", got, wantInsert)
+	}
+
+	remove := testRowsEvent(replication.DELETE_ROWS_EVENTv2, []byte{0x07}, nil, rows...)
+	wantDelete := []string{
+		"DELETE FROM `shop`.`t` WHERE `id`=1 LIMIT 1;",
+		"DELETE FROM `shop`.`t` WHERE `id`=2 LIMIT 1;",
+		"DELETE FROM `shop`.`t` WHERE `id`=3 LIMIT 1;",
+	}
+	if got := genDeleteSql(testRowImageMetadata, remove.Event.(*replication.RowsEvent), true); !reflect.DeepEqual(got, wantDelete) {
+		t.Errorf("genDeleteSql() = %q, want %q", got, wantDelete)
+	}
+
+	// 两对before/after, 每对一条sql
+	update := testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x07},
+		rows[0], []interface{}{int32(1), "b", nil},
+		rows[2], []interface{}{int32(3), "d", nil})
+	updateRows := update.Event.(*replication.RowsEvent)
+	wantUpdate := []string{
+		"UPDATE `shop`.`t` SET `id`=1, `name`='b', `content`=NULL WHERE `id`=1 LIMIT 1;",
+		"UPDATE `shop`.`t` SET `id`=3, `name`='d', `content`=NULL WHERE `id`=3 LIMIT 1;",
+	}
+	if got := genUpdateSql(testRowImageMetadata, updateRows, false, true, false); !reflect.DeepEqual(got, wantUpdate) {
+		t.Errorf("genUpdateSql() = %q, want %q", got, wantUpdate)
+	}
+	wantRollback := []string{
+		"UPDATE `shop`.`t` SET `id`=1, `name`='a', `content`=NULL WHERE `id`=1 LIMIT 1;",
+		"UPDATE `shop`.`t` SET `id`=3, `name`='c', `content`=NULL WHERE `id`=3 LIMIT 1;",
+	}
+	if got := genUpdateSql(testRowImageMetadata, updateRows, true, true, false); !reflect.DeepEqual(got, wantRollback) {
+		t.Errorf("genUpdateSql(reverse) = %q, want %q", got, wantRollback)
+	}
+}
+
+func TestBuildWhereExp(t *testing.T) {
+	noKey := *testRowImageMetadata
+	noKey.Keys = nil
+	compositeKey := *testRowImageMetadata
+	compositeKey.Keys = []int{0, 1}
+	row := []interface{}{int32(1), "a", nil}
+
+	tests := []struct {
+		name          string
+		tableMetadata *TableMetadata
+		present       columnPresence
+		useKey        bool
+		want          string
+	}{
+		{"key", testRowImageMetadata, nil, true, "`id`=1"},
+		{"all columns", testRowImageMetadata, nil, false, "`id`=1 AND `name`='a' AND `content` IS NULL"},
+		{"no key", &noKey, nil, true, "`id`=1 AND `name`='a' AND `content` IS NULL"},
+		{"composite key", &compositeKey, nil, true, "`id`=1 AND `name`='a'"},
+		// 行中没有记录键的列时只能使用记录了的列
+		{"key not present", testRowImageMetadata, columnPresence{0x06}, true, "`name`='a' AND `content` IS NULL"},
+		{"all present columns", testRowImageMetadata, columnPresence{0x03}, false, "`id`=1 AND `name`='a'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildWhereExp(tt.tableMetadata, row, tt.present, tt.useKey); got != tt.want {
+				t.Errorf("buildWhereExp() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// minimal时只有SET不同, WHERE与完整的UPDATE相同
+func TestGenMinimalUpdateSql(t *testing.T) {
+	noKey := *testRowImageMetadata
+	noKey.Keys = nil
+	tests := []struct {
+		name          string
+		tableMetadata *TableMetadata
+		event         *replication.BinlogEvent
+		useKey        bool
+		wantFull      string
+		wantMinimal   string
+	}{
+		{
+			// MINIMAL: 修改前只记录主键, 修改后只记录修改的列
+			name:          "minimal image with key",
+			tableMetadata: testRowImageMetadata,
+			event:         testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x01}, []byte{0x02}, []interface{}{int32(1), nil, nil}, []interface{}{nil, "b", nil}),
+			useKey:        true,
+			wantFull:      "UPDATE `shop`.`t` SET `id`=1, `name`='b' WHERE `id`=1 LIMIT 1;",
+			wantMinimal:   "UPDATE `shop`.`t` SET `name`='b' WHERE `id`=1 LIMIT 1;",
+		},
+		{
+			name:          "minimal image without use key",
+			tableMetadata: testRowImageMetadata,
+			event:         testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x01}, []byte{0x02}, []interface{}{int32(1), nil, nil}, []interface{}{nil, "b", nil}),
+			wantFull:      "UPDATE `shop`.`t` SET `id`=1, `name`='b' WHERE `id`=1 LIMIT 1;",
+			wantMinimal:   "UPDATE `shop`.`t` SET `name`='b' WHERE `id`=1 LIMIT 1;",
+		},
+		{
+			// 表没有键时MINIMAL的修改前记录全部列
+			name:          "minimal image without key",
+			tableMetadata: &noKey,
+			event:         testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x02}, []interface{}{int32(1), "a", nil}, []interface{}{nil, "b", nil}),
+			useKey:        true,
+			wantFull:      "UPDATE `shop`.`t` SET `id`=1, `name`='b', `content`=NULL WHERE `id`=1 AND `name`='a' AND `content` IS NULL LIMIT 1;",
+			wantMinimal:   "UPDATE `shop`.`t` SET `name`='b' WHERE `id`=1 AND `name`='a' AND `content` IS NULL LIMIT 1;",
+		},
+		{
+			name:          "full image with key",
+			tableMetadata: testRowImageMetadata,
+			event:         testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x07}, []interface{}{int32(1), "a", nil}, []interface{}{int32(1), "b", nil}),
+			useKey:        true,
+			wantFull:      "UPDATE `shop`.`t` SET `id`=1, `name`='b', `content`=NULL WHERE `id`=1 LIMIT 1;",
+			wantMinimal:   "UPDATE `shop`.`t` SET `name`='b' WHERE `id`=1 LIMIT 1;",
+		},
+		{
+			name:          "full image without use key",
+			tableMetadata: testRowImageMetadata,
+			event:         testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x07}, []interface{}{int32(1), "a", nil}, []interface{}{int32(1), "b", nil}),
+			wantFull:      "UPDATE `shop`.`t` SET `id`=1, `name`='b', `content`=NULL WHERE `id`=1 AND `name`='a' AND `content` IS NULL LIMIT 1;",
+			wantMinimal:   "UPDATE `shop`.`t` SET `name`='b' WHERE `id`=1 AND `name`='a' AND `content` IS NULL LIMIT 1;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rowsEvent := tt.event.Event.(*replication.RowsEvent)
+			full := genUpdateSql(tt.tableMetadata, rowsEvent, false, tt.useKey, false)
+			if len(full) != 1 || full[0] != tt.wantFull {
+				t.Errorf("full = %q, want %q", full, tt.wantFull)
+			}
+			minimal := genUpdateSql(tt.tableMetadata, rowsEvent, false, tt.useKey, true)
+			if len(minimal) != 1 || minimal[0] != tt.wantMinimal {
+				t.Errorf("minimal = %q, want %q", minimal, tt.wantMinimal)
+			}
+		})
+	}
+
+	// 修改前后相同的行不生成sql
+	same := testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x07}, []interface{}{int32(1), "a", nil}, []interface{}{int32(1), "a", nil})
+	if got := genUpdateSql(testRowImageMetadata, same.Event.(*replication.RowsEvent), false, true, true); len(got) != 0 {
+		t.Errorf("minimal of unchanged row = %q, want none", got)
+	}
+}
+
+// rollback输出按事务分组倒序, 保留开头的SET, 最后不完整的事务整个注释掉
+func TestRollbackTransactions(t *testing.T) {
+	b := newTestBinlog()
+	_, start1 := b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(2), "b"})
+	rows1 := b.pos
+	b.commit(11)
+	end1 := b.pos
+	_, start2 := b.begin(2)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(1), "x"})
+	update2 := b.pos
+	b.tableMap(1, "t")
+	b.rows(replication.DELETE_ROWS_EVENTv2, 1, []interface{}{int32(2), "b"})
+	delete2 := b.pos
+	b.commit(12)
+	end2 := b.pos
+	// 在事务3的XID_EVENT之前结束
+	_, start3 := b.begin(3)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(3), nil})
+	rows3 := b.pos
+	b.commit(13)
+	end3 := b.pos
+
+	dir := t.TempDir()
+	b.save(t, dir, "mysql-bin.000001")
+	cfg := testOfflineConfig(t, dir)
+	cfg.StopFile = cfg.StartFile
+	cfg.StopPos = rows3
+	cfg.Rollback = true
+	_, output, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventTime := time.Unix(testBinlogTime, 0).Format(layout)
+	gtid := testServerUUID.String()
+	want := "SET time_zone='+00:00';\n" +
+		fmt.Sprintf("-- BEGIN; /* ROLLBACK -> Transaction ROLLBACK | gtid: %s:3 | incomplete transaction | binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", gtid, start3, end3, eventTime) +
+		fmt.Sprintf("-- DELETE FROM `shop`.`t` WHERE `id`=3 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start3, rows3, eventTime) +
+		"-- COMMIT;\n\n" +
+		fmt.Sprintf("BEGIN; /* ROLLBACK -> Transaction ROLLBACK | gtid: %s:2 | xid: 12 | binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", gtid, start2, end2, eventTime) +
+		fmt.Sprintf("INSERT INTO `shop`.`t`(`id`, `name`) VALUES (2, 'b'); /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start2, delete2, eventTime) +
+		fmt.Sprintf("UPDATE `shop`.`t` SET `id`=1, `name`='a' WHERE `id`=1 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start2, update2, eventTime) +
+		"COMMIT;\n\n" +
+		fmt.Sprintf("BEGIN; /* ROLLBACK -> Transaction ROLLBACK | gtid: %s:1 | xid: 11 | binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", gtid, start1, end1, eventTime) +
+		fmt.Sprintf("DELETE FROM `shop`.`t` WHERE `id`=2 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start1, rows1, eventTime) +
+		fmt.Sprintf("DELETE FROM `shop`.`t` WHERE `id`=1 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start1, rows1, eventTime) +
+		"COMMIT;\n"
+	if output != want {
+		t.Errorf("output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+// 前n次Err()返回nil, 之后为context.Canceled. 解析时每个event前检查一次, 用来在指定的event处取消
+type testCancelContext struct {
+	context.Context
+	n int
+}
+
+func (c *testCancelContext) Err() error {
+	if c.n > 0 {
+		c.n--
+		return nil
+	}
+	return context.Canceled
+}
+
+func TestFlashbackCanceled(t *testing.T) {
+	b := newTestBinlog()
+	_, start1 := b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"})
+	rows1 := b.pos
+	b.commit(1)
+	end1 := b.pos
+	_, start2 := b.begin(2)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(2), "b"})
+	rows2 := b.pos
+	b.commit(2)
+	b.tx(3)
+	dir := t.TempDir()
+	b.save(t, dir, "mysql-bin.000001")
+
+	eventTime := time.Unix(testBinlogTime, 0).Format(layout)
+	gtid := testServerUUID.String()
+	// 事务2的XID_EVENT之前取消, 事务2没有结束
+	want := "SET time_zone='+00:00';\n" +
+		fmt.Sprintf("-- BEGIN; /* ROLLBACK -> Transaction ROLLBACK | gtid: %s:2 | incomplete transaction | binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", gtid, start2, rows2, eventTime) +
+		fmt.Sprintf("-- DELETE FROM `shop`.`t` WHERE `id`=2 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start2, rows2, eventTime) +
+		"-- COMMIT;\n\n" +
+		fmt.Sprintf("BEGIN; /* ROLLBACK -> Transaction ROLLBACK | gtid: %s:1 | xid: 1 | binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", gtid, start1, end1, eventTime) +
+		fmt.Sprintf("DELETE FROM `shop`.`t` WHERE `id`=1 LIMIT 1; /* ROW -> binlog: mysql-bin.000001 | pos: (%d, %d) | time: %s */\n", start1, rows1, eventTime) +
+		"COMMIT;\n"
+
+	for _, removePartial := range []bool{false, true} {
+		cfg := testOfflineConfig(t, dir)
+		cfg.Rollback = true
+		cfg.RemovePartial = removePartial
+		fb, err := NewFlashback(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// FORMAT_DESCRIPTION_EVENT, 事务1的5个event, 事务2的XID_EVENT之前的4个event
+		err = fb.FlashbackContext(&testCancelContext{Context: context.Background(), n: 10})
+		fb.Close()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("error = %v, want %v", err, context.Canceled)
+		}
+
+		output, readErr := os.ReadFile(cfg.OutputFile)
+		if removePartial {
+			wantErr := fmt.Sprintf("context canceled: stopped after mysql-bin.000001:%d, partial output removed: %s", rows2, cfg.OutputFile)
+			if err.Error() != wantErr {
+				t.Errorf("error = %v, want %s", err, wantErr)
+			}
+			if !os.IsNotExist(readErr) {
+				t.Errorf("partial output not removed: %v", readErr)
+			}
+			continue
+		}
+		wantErr := fmt.Sprintf("context canceled: stopped after mysql-bin.000001:%d, partial rollback sql reversed in %s", rows2, cfg.OutputFile)
+		if err.Error() != wantErr {
+			t.Errorf("error = %v, want %s", err, wantErr)
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if string(output) != want {
+			t.Errorf("output:\n%s\nwant:\n%s", output, want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package mysql_flashback
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+// 输出格式
+const (
+	FormatSQL   = "sql"   // 标准sql, 位置信息在注释中
+	FormatJSONL = "jsonl" // 每行一个json对象, 只包含行变更
+	FormatCSV   = "csv"   // 输出到目录, 每个表一个csv文件
+
+	FormatDebezium = "debezium" // Debezium的事件格式(不含schema), 每行一个
+	FormatCanal    = "canal"    // Canal的FlatMessage, 每行一个, 同一个ROWS_EVENT的行合并为一条
+)
+
+// 一行数据的变更. rollback模式下为回滚操作本身: 如原来的INSERT输出为DELETE, UPDATE的before/after互换
+type RowChange struct {
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	Type       string                 `json:"type"` // INSERT, UPDATE, DELETE
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+	PrimaryKey map[string]interface{} `json:"primary_key,omitempty"` // 主键(或第一个非空唯一键)的值, 取变更前的行, INSERT时取变更后的行
+	Rollback   bool                   `json:"rollback,omitempty"`
+	File       string                 `json:"file"`
+	StartPos   uint32                 `json:"start_pos"` // 事务开始的位置
+	EndPos     uint32                 `json:"end_pos"`   // ROWS_EVENT结束的位置
+	Timestamp  uint32                 `json:"timestamp"`
+	GTID       string                 `json:"gtid,omitempty"`
+	Xid        uint64                 `json:"xid,omitempty"` // 事务没有XID_EVENT(非事务引擎或被截断)时为空
+
+	tableMetadata *TableMetadata
+	before, after []interface{}
+	eventPos      uint32 // ROWS_EVENT开始的位置
+	row           int    // 在ROWS_EVENT中的序号
+	serverID      uint32
+	// binlog_row_image不为FULL时行中记录了的列, 没有记录的列不输出
+	beforePresent, afterPresent columnPresence
+}
+
+// 一个ROWS_EVENT中的每一行生成一个RowChange
+func newRowChanges(tableMetadata *TableMetadata, e *replication.BinlogEvent, rollback bool) []*RowChange {
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	var changes []*RowChange
+	add := func(typ string, before, after []interface{}, beforePresent, afterPresent columnPresence) {
+		row := len(changes)
+		change := &RowChange{
+			Schema:    tableMetadata.Schema,
+			Table:     tableMetadata.Table,
+			Type:      typ,
+			Rollback:  rollback,
+			EndPos:    e.Header.LogPos,
+			Timestamp: e.Header.Timestamp,
+
+			tableMetadata: tableMetadata,
+			before:        before,
+			after:         after,
+			beforePresent: beforePresent,
+			afterPresent:  afterPresent,
+			eventPos:      e.Header.LogPos - e.Header.EventSize,
+			row:           row,
+			serverID:      e.Header.ServerID,
+		}
+		if before != nil {
+			change.Before = rowImage(tableMetadata, before, beforePresent, nil)
+			change.PrimaryKey = rowImage(tableMetadata, before, beforePresent, tableMetadata.Keys)
+		}
+		if after != nil {
+			change.After = rowImage(tableMetadata, after, afterPresent, nil)
+			if before == nil {
+				change.PrimaryKey = rowImage(tableMetadata, after, afterPresent, tableMetadata.Keys)
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	switch e.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		for i := range rowsEvent.Rows {
+			row, present := rowAt(rowsEvent, i)
+			if rollback {
+				add("DELETE", row, nil, present, nil)
+			} else {
+				add("INSERT", nil, row, nil, present)
+			}
+		}
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		for i := 0; i+1 < len(rowsEvent.Rows); i += 2 {
+			before, beforePresent := rowAt(rowsEvent, i)
+			after, afterPresent := rowAt(rowsEvent, i+1)
+			if rollback {
+				add("UPDATE", after, before, afterPresent, beforePresent)
+			} else {
+				add("UPDATE", before, after, beforePresent, afterPresent)
+			}
+		}
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		for i := range rowsEvent.Rows {
+			row, present := rowAt(rowsEvent, i)
+			if rollback {
+				add("INSERT", nil, row, nil, present)
+			} else {
+				add("DELETE", row, nil, present, nil)
+			}
+		}
+	}
+	return changes
+}
+
+// map[columnName]value, fields为空时为整行, 否则只包含这些字段. 没有记录的列不包含在内
+func rowImage(tableMetadata *TableMetadata, row []interface{}, present columnPresence, fields []int) map[string]interface{} {
+	if fields == nil {
+		fields = make([]int, len(row))
+		for idx := range row {
+			fields[idx] = idx
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	image := make(map[string]interface{}, len(fields))
+	for _, idx := range fields {
+		if idx >= len(row) || !present.has(idx) {
+			continue
+		}
+		image[tableMetadata.Fields[idx]] = buildJSONFieldValue(row[idx], tableMetadata.Columns[idx])
+	}
+	return image
+}
+
+// 将binlog中解码出的值按字段类型转换为json的值. 整数和decimal保留原样的精度,
+// 二进制和geometry为hex字符串, json字段为json对象本身
+func buildJSONFieldValue(value interface{}, column *Column) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	if column != nil {
+		switch column.DataType {
+		case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+			return json.Number(buildIntegerValue(value, column))
+		case "bit":
+			if v, ok := value.(int64); ok {
+				return uint64(v)
+			}
+		case "enum":
+			if v, ok := value.(int64); ok {
+				if element, ok := enumElement(v, column); ok {
+					return element
+				}
+			}
+		case "set":
+			if v, ok := value.(int64); ok {
+				if elements, ok := setElements(v, column); ok {
+					return elements
+				}
+			}
+		case "json":
+			if b := toBytes(value); json.Valid(b) {
+				return json.RawMessage(b)
+			}
+			return string(toBytes(value))
+		}
+		if column.IsBinary() || column.IsGeometry() {
+			return hex.EncodeToString(toBytes(value))
+		}
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		if column == nil {
+			return hex.EncodeToString(v)
+		}
+		return string(v)
+	case decimal.Decimal:
+		return json.Number(v.String())
+	case time.Time:
+		return v.UTC().Format(timeLayout)
+	default:
+		return v
+	}
+}
+
+// 非sql格式下事务内的变更先缓存, 事务结束时拿到xid再输出
+func (fb *Flashback) flushRowChanges(xid uint64) error {
+	for _, change := range fb.txChanges {
+		change.Xid = xid
+	}
+	defer func() { fb.txChanges = fb.txChanges[:0] }()
+
+	if fb.format == FormatCSV {
+		for _, change := range fb.txChanges {
+			fb.changeChan <- change
+		}
+		return nil
+	}
+	lines, err := fb.formatter.format(fb.txChanges)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, line := range lines {
+		fb.outputChan <- line
+	}
+	return nil
+}
+
+// 将一个事务的变更转换为输出的行
+type rowFormatter interface {
+	format(changes []*RowChange) ([]string, error)
+}
+
+func newRowFormatter(format string) rowFormatter {
+	switch format {
+	case FormatJSONL:
+		return jsonlFormatter{}
+	case FormatDebezium:
+		return debeziumFormatter{}
+	case FormatCanal:
+		return &canalFormatter{}
+	}
+	return nil
+}
+
+type jsonlFormatter struct{}
+
+func (jsonlFormatter) format(changes []*RowChange) ([]string, error) {
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		b, err := json.Marshal(change)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		lines = append(lines, string(b))
+	}
+	return lines, nil
+}
@@ -0,0 +1,107 @@
+package mysql_flashback
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/shopspring/decimal"
+)
+
+// 一个事务: INSERT两行(其中一行name为NULL), UPDATE一行, DELETE一行
+func testFormatBinlog(t *testing.T, dir string) {
+	b := newTestBinlog()
+	b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(2), nil})
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(1), `b,"c"`})
+	b.tableMap(1, "t")
+	b.rows(replication.DELETE_ROWS_EVENTv2, 1, []interface{}{int32(2), nil})
+	b.commit(7)
+	b.save(t, dir, "mysql-bin.000001")
+}
+
+// 按format输出testFormatBinlog, 返回输出的行
+func testFormatOutput(t *testing.T, format string, rollback bool) []string {
+	t.Helper()
+	dir := t.TempDir()
+	testFormatBinlog(t, dir)
+	cfg := testOfflineConfig(t, dir)
+	cfg.Format = format
+	cfg.Rollback = rollback
+	_, output, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+func testCompareLines(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("line %d:\n got: %s\nwant: %s", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestJSONLFormat(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatJSONL, false), []string{
+		`{"schema":"shop","table":"t","type":"INSERT","after":{"id":1,"name":"a"},"primary_key":{"id":1},"file":"mysql-bin.000001","start_pos":186,"end_pos":314,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"INSERT","after":{"id":2,"name":null},"primary_key":{"id":2},"file":"mysql-bin.000001","start_pos":186,"end_pos":314,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"UPDATE","before":{"id":1,"name":"a"},"after":{"id":1,"name":"b,\"c\""},"primary_key":{"id":1},"file":"mysql-bin.000001","start_pos":186,"end_pos":407,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"DELETE","before":{"id":2,"name":null},"primary_key":{"id":2},"file":"mysql-bin.000001","start_pos":186,"end_pos":486,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+	})
+}
+
+// rollback时输出回滚操作, 顺序倒序
+func TestJSONLFormatRollback(t *testing.T) {
+	testCompareLines(t, testFormatOutput(t, FormatJSONL, true), []string{
+		`{"schema":"shop","table":"t","type":"INSERT","after":{"id":2,"name":null},"primary_key":{"id":2},"rollback":true,"file":"mysql-bin.000001","start_pos":186,"end_pos":486,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"UPDATE","before":{"id":1,"name":"b,\"c\""},"after":{"id":1,"name":"a"},"primary_key":{"id":1},"rollback":true,"file":"mysql-bin.000001","start_pos":186,"end_pos":407,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"DELETE","before":{"id":2,"name":null},"primary_key":{"id":2},"rollback":true,"file":"mysql-bin.000001","start_pos":186,"end_pos":314,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+		`{"schema":"shop","table":"t","type":"DELETE","before":{"id":1,"name":"a"},"primary_key":{"id":1},"rollback":true,"file":"mysql-bin.000001","start_pos":186,"end_pos":314,"timestamp":1700000000,"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1","xid":7}`,
+	})
+}
+
+func TestBuildJSONFieldValue(t *testing.T) {
+	enum := &Column{DataType: "enum", Elements: []string{"new", "paid"}}
+	set := &Column{DataType: "set", Elements: []string{"a", "b", "c"}}
+	tests := []struct {
+		name   string
+		value  interface{}
+		column *Column
+		want   interface{}
+	}{
+		{"null", nil, enum, nil},
+		{"unsigned int", int32(-1), &Column{DataType: "int", Unsigned: true}, json.Number("4294967295")},
+		{"unsigned bigint", int64(-1), &Column{DataType: "bigint", Unsigned: true}, json.Number("18446744073709551615")},
+		{"signed int", int32(-1), &Column{DataType: "int"}, json.Number("-1")},
+		{"bit", int64(5), &Column{DataType: "bit"}, uint64(5)},
+		{"enum", int64(2), enum, "paid"},
+		{"enum out of range", int64(3), enum, int64(3)},
+		{"set", int64(5), set, "a,c"},
+		{"json", []byte(`{"a":[1,2]}`), &Column{DataType: "json"}, json.RawMessage(`{"a":[1,2]}`)},
+		{"json invalid", "{", &Column{DataType: "json"}, "{"},
+		{"binary", []byte{0x00, 0xff}, &Column{DataType: "varbinary"}, "00ff"},
+		{"geometry", []byte{0x00, 0x01}, &Column{DataType: "point"}, "0001"},
+		{"text", []byte("abc"), &Column{DataType: "text"}, "abc"},
+		{"decimal", decimal.RequireFromString("12345678901234567890.123456789"), &Column{DataType: "decimal"}, json.Number("12345678901234567890.123456789")},
+		{"datetime", time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC), &Column{DataType: "datetime"}, "2024-01-02 03:04:05.6"},
+		{"no column bytes", []byte("ab"), nil, "6162"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildJSONFieldValue(tt.value, tt.column); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildJSONFieldValue(%v) = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package mysql_flashback
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+)
+
+// 按GTID集合过滤整个事务, 格式同mysqlbinlog --include-gtids: 3E11FA47-71CA-11E1-9E33-C80AA9429562:23-57:60,uuid:1-5
+type gtidFilter struct {
+	include *mysql.MysqlGTIDSet // 为nil则不过滤
+	exclude *mysql.MysqlGTIDSet
+	pending map[string]int64 // map[uuid]include中最大的gno, 全部超过后即可结束解析
+}
+
+func newGtidFilter(include, exclude string) (*gtidFilter, error) {
+	if include == "" && exclude == "" {
+		return nil, nil
+	}
+	f := &gtidFilter{}
+	if include != "" {
+		set, err := parseGtidSet(include)
+		if err != nil {
+			return nil, errors.Annotate(err, "include gtids is illegal")
+		}
+		f.include = set
+		f.resetPending()
+	}
+	if exclude != "" {
+		set, err := parseGtidSet(exclude)
+		if err != nil {
+			return nil, errors.Annotate(err, "exclude gtids is illegal")
+		}
+		f.exclude = set
+	}
+	return f, nil
+}
+
+func parseGtidSet(str string) (*mysql.MysqlGTIDSet, error) {
+	set, err := mysql.ParseMysqlGTIDSet(str)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return set.(*mysql.MysqlGTIDSet), nil
+}
+
+// 复制出还没有解析过任何事务的filter
+func (f *gtidFilter) clone() *gtidFilter {
+	if f == nil {
+		return nil
+	}
+	n := *f
+	n.resetPending()
+	return &n
+}
+
+func (f *gtidFilter) resetPending() {
+	if f.include == nil {
+		return
+	}
+	f.pending = make(map[string]int64, len(f.include.Sets))
+	for sid, uuidSet := range f.include.Sets {
+		if n := len(uuidSet.Intervals); n != 0 {
+			f.pending[sid] = uuidSet.Intervals[n-1].Stop - 1
+		}
+	}
+}
+
+// include中每个uuid第一个gno之前的事务都不在解析范围内, 远程模式下可以让服务端直接跳过. 没有指定include时返回nil
+func (f *gtidFilter) skipped() *mysql.MysqlGTIDSet {
+	if f == nil || f.include == nil {
+		return nil
+	}
+	set := &mysql.MysqlGTIDSet{Sets: make(map[string]*mysql.UUIDSet)}
+	for _, uuidSet := range f.include.Sets {
+		if len(uuidSet.Intervals) != 0 && uuidSet.Intervals[0].Start > 1 {
+			set.AddSet(mysql.NewUUIDSet(uuidSet.SID, mysql.Interval{Start: 1, Stop: uuidSet.Intervals[0].Start}))
+		}
+	}
+	return set
+}
+
+// 没有GTID的事务(ANONYMOUS_GTID_EVENT)只在没有指定include时保留
+func (f *gtidFilter) matchAnonymous() bool {
+	return f.include == nil
+}
+
+func (f *gtidFilter) match(sid uuid.UUID, gno int64) bool {
+	if f.include != nil && !containsGtid(f.include, sid, gno) {
+		return false
+	}
+	if f.exclude != nil && containsGtid(f.exclude, sid, gno) {
+		return false
+	}
+	return true
+}
+
+// 同一个uuid的gno在binlog中是递增的, include中所有uuid的gno都超过集合上限后, 之后不会再有需要的事务
+func (f *gtidFilter) passed(sid uuid.UUID, gno int64) bool {
+	if f.include == nil {
+		return false
+	}
+	key := sid.String()
+	if last, ok := f.pending[key]; ok && gno > last {
+		delete(f.pending, key)
+	}
+	return len(f.pending) == 0
+}
+
+func containsGtid(set *mysql.MysqlGTIDSet, sid uuid.UUID, gno int64) bool {
+	uuidSet, ok := set.Sets[sid.String()]
+	if !ok {
+		return false
+	}
+	for _, interval := range uuidSet.Intervals {
+		if gno >= interval.Start && gno < interval.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// GTID_EVENT的gtid, 格式: uuid:gno
+func gtidOfEvent(e *replication.GTIDEvent) (uuid.UUID, string, error) {
+	sid, err := uuid.FromBytes(e.SID)
+	if err != nil {
+		return sid, "", errors.Trace(err)
+	}
+	return sid, fmt.Sprintf("%s:%d", sid, e.GNO), nil
+}
@@ -0,0 +1,117 @@
+package mysql_flashback
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	testGtidSID1 = uuid.MustParse("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	testGtidSID2 = uuid.MustParse("4d22ab58-82db-22f2-af44-d91bba530673")
+)
+
+func TestGtidFilterMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		sid     uuid.UUID
+		gno     int64
+		want    bool
+	}{
+		{"include in range", "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57:60", "", testGtidSID1, 23, true},
+		{"include range end", "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57:60", "", testGtidSID1, 57, true},
+		{"include gap", "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57:60", "", testGtidSID1, 58, false},
+		{"include single", "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57:60", "", testGtidSID1, 60, true},
+		{"include other uuid", "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57", "", testGtidSID2, 30, false},
+		{"exclude", "", "3e11fa47-71ca-11e1-9e33-c80aa9429562:5", testGtidSID1, 5, false},
+		{"exclude other", "", "3e11fa47-71ca-11e1-9e33-c80aa9429562:5", testGtidSID1, 6, true},
+		{"exclude takes precedence", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10", "3e11fa47-71ca-11e1-9e33-c80aa9429562:5", testGtidSID1, 5, false},
+		{"upper case uuid", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-10", "", testGtidSID1, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newGtidFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.match(tt.sid, tt.gno); got != tt.want {
+				t.Errorf("match(%s:%d) = %v, want %v", tt.sid, tt.gno, got, tt.want)
+			}
+			if got := f.matchAnonymous(); got != (tt.include == "") {
+				t.Errorf("matchAnonymous() = %v, want %v", got, tt.include == "")
+			}
+		})
+	}
+}
+
+func TestNewGtidFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		exclude  string
+		wantNil  bool
+		wantErr  bool
+		wantSkip string // skipped()的结果
+	}{
+		{name: "empty", wantNil: true},
+		{name: "illegal include", include: "abc:1", wantErr: true},
+		{name: "illegal exclude", exclude: "3e11fa47-71ca-11e1-9e33-c80aa9429562:x", wantErr: true},
+		{name: "include from first", include: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"},
+		{name: "include later", include: "3e11fa47-71ca-11e1-9e33-c80aa9429562:23-57:60", wantSkip: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-22"},
+		{
+			name:     "include two uuids",
+			include:  "3e11fa47-71ca-11e1-9e33-c80aa9429562:3,4d22ab58-82db-22f2-af44-d91bba530673:1-2",
+			wantSkip: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newGtidFilter(tt.include, tt.exclude)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newGtidFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (f == nil) != tt.wantNil {
+				t.Fatalf("newGtidFilter() = %v, wantNil %v", f, tt.wantNil)
+			}
+			if f == nil {
+				return
+			}
+			if got := f.skipped().String(); got != tt.wantSkip {
+				t.Errorf("skipped() = %q, want %q", got, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestGtidFilterPassed(t *testing.T) {
+	f, err := newGtidFilter("3e11fa47-71ca-11e1-9e33-c80aa9429562:3-5,4d22ab58-82db-22f2-af44-d91bba530673:2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		sid  uuid.UUID
+		gno  int64
+		want bool
+	}{
+		{testGtidSID1, 4, false},
+		{testGtidSID1, 5, false},
+		{testGtidSID1, 6, false}, // 另一个uuid还没有结束
+		{testGtidSID2, 2, false},
+		{testGtidSID2, 3, true},
+	}
+	for i, step := range steps {
+		if got := f.passed(step.sid, step.gno); got != step.want {
+			t.Fatalf("step %d: passed(%s:%d) = %v, want %v", i, step.sid, step.gno, got, step.want)
+		}
+	}
+
+	// clone之后重新计算
+	if f.clone().passed(testGtidSID1, 6) {
+		t.Errorf("clone().passed() = true, want false")
+	}
+}
@@ -0,0 +1,318 @@
+package mysql_flashback
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// binlog中的位置, file为binlog文件名. 同一前缀的binlog文件按数字后缀比较先后(mysql-bin.999999之后为mysql-bin.1000000)
+type BinlogPosition struct {
+	File string
+	Pos  uint32
+}
+
+func (p BinlogPosition) Less(o BinlogPosition) bool {
+	if p.File != o.File {
+		return lessBinlogFile(p.File, o.File)
+	}
+	return p.Pos < o.Pos
+}
+
+func lessBinlogFile(a, b string) bool {
+	aPrefix, aSeq, aErr := splitBinlogFile(a)
+	bPrefix, bSeq, bErr := splitBinlogFile(b)
+	if aErr != nil || bErr != nil || aPrefix != bPrefix {
+		return a < b
+	}
+	return aSeq < bSeq
+}
+
+// mysql-bin.000026 => mysql-bin, 26
+func splitBinlogFile(file string) (string, uint64, error) {
+	idx := strings.LastIndex(file, ".")
+	if idx == -1 {
+		return "", 0, fmt.Errorf("binlog file name is illegal: %s", file)
+	}
+	seq, err := strconv.ParseUint(file[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	return file[:idx], seq, nil
+}
+
+// 某个位置之后生效的表结构, table为nil表示表已被删除
+type schemaVersion struct {
+	pos   BinlogPosition
+	table *TableSchema
+}
+
+// 表结构历史: 以base为起点(应为start-file时刻的表结构), 按binlog顺序重放QUERY_EVENT中的DDL,
+// 保存每个表的所有版本, 解析TABLE_MAP_EVENT时使用当时生效的版本. 实现了SchemaProvider
+type SchemaHistory struct {
+	base     SchemaProvider
+	parser   *parser.Parser
+	versions map[string][]*schemaVersion // map[schema.table]versions, 按位置升序
+	dropped  map[string]BinlogPosition   // map[schema]DROP DATABASE的位置
+	current  BinlogPosition              // 最后一次应用DDL的位置
+}
+
+func NewSchemaHistory(base SchemaProvider) *SchemaHistory {
+	return &SchemaHistory{
+		base:     base,
+		parser:   parser.New(),
+		versions: make(map[string][]*schemaVersion),
+		dropped:  make(map[string]BinlogPosition),
+	}
+}
+
+// 返回最新的表结构
+func (h *SchemaHistory) TableSchema(schema, table string) (*TableSchema, error) {
+	return h.TableSchemaAt(schema, table, h.current)
+}
+
+// 返回pos处生效的表结构
+func (h *SchemaHistory) TableSchemaAt(schema, table string, pos BinlogPosition) (*TableSchema, error) {
+	key := snapshotKey(schema, table)
+	versions, ok := h.versions[key]
+	if !ok {
+		if droppedPos, ok := h.dropped[schema]; ok && !pos.Less(droppedPos) {
+			return nil, fmt.Errorf("%w: database dropped at %s:%d: %s", ErrTableMetadataMissing, droppedPos.File, droppedPos.Pos, schema)
+		}
+		return h.loadBase(schema, table)
+	}
+
+	// 第一个位置大于pos的版本的前一个
+	idx := sort.Search(len(versions), func(i int) bool {
+		return pos.Less(versions[i].pos)
+	})
+	if idx == 0 {
+		return h.loadBase(schema, table)
+	}
+	if versions[idx-1].table == nil {
+		return nil, fmt.Errorf("%w: table dropped at %s:%d: %s.%s", ErrTableMetadataMissing, versions[idx-1].pos.File, versions[idx-1].pos.Pos, schema, table)
+	}
+	return versions[idx-1].table, nil
+}
+
+func (h *SchemaHistory) loadBase(schema, table string) (*TableSchema, error) {
+	tableSchema, err := h.base.TableSchema(schema, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return tableSchema, nil
+}
+
+func (h *SchemaHistory) put(pos BinlogPosition, schema, table string, tableSchema *TableSchema) {
+	key := snapshotKey(schema, table)
+	h.versions[key] = append(h.versions[key], &schemaVersion{pos: pos, table: tableSchema})
+}
+
+// 修改前复制当前版本, 表不存在时返回nil
+func (h *SchemaHistory) editable(schema, table string) *TableSchema {
+	tableSchema, err := h.TableSchema(schema, table)
+	if err != nil {
+		return nil
+	}
+	return tableSchema.clone()
+}
+
+// 应用QUERY_EVENT中的DDL, 返回结构发生变化的表(schema.table). 无法解析的语句会被忽略
+func (h *SchemaHistory) Apply(pos BinlogPosition, defaultSchema string, query string) ([]string, error) {
+	stmts, _, err := h.parser.Parse(query, "", "")
+	if err != nil {
+		if rewritten := rewriteSpatialTypes(query); rewritten != query {
+			stmts, _, err = h.parser.Parse(rewritten, "", "")
+		}
+		if err != nil {
+			if isDDL(query) {
+				log.Warnf("skip unsupported ddl at %s:%d: %s", pos.File, pos.Pos, err)
+			}
+			return nil, nil
+		}
+	}
+
+	h.current = pos
+	var changed []string
+	for _, stmt := range stmts {
+		keys, err := h.applyStmt(pos, defaultSchema, stmt)
+		if err != nil {
+			return nil, errors.Annotatef(err, "apply ddl at %s:%d", pos.File, pos.Pos)
+		}
+		changed = append(changed, keys...)
+	}
+	return changed, nil
+}
+
+func isDDL(query string) bool {
+	query = strings.ToUpper(strings.TrimSpace(query))
+	for _, prefix := range []string{"CREATE", "ALTER", "DROP", "RENAME"} {
+		if strings.HasPrefix(query, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func tableNameOf(name *ast.TableName, defaultSchema string) (schema, table string) {
+	schema = name.Schema.O
+	if schema == "" {
+		schema = defaultSchema
+	}
+	return schema, name.Name.O
+}
+
+func (h *SchemaHistory) applyStmt(pos BinlogPosition, defaultSchema string, stmt ast.StmtNode) (changed []string, err error) {
+	switch stmt := stmt.(type) {
+	case *ast.CreateTableStmt:
+		snapshot := NewSchemaSnapshot()
+		if stmt.ReferTable != nil {
+			referSchema, referTable := tableNameOf(stmt.ReferTable, defaultSchema)
+			if refer, err := h.TableSchema(referSchema, referTable); err == nil {
+				snapshot.Put(refer)
+			}
+		}
+		if tableSchema := tableSchemaFromCreateStmt(snapshot, stmt, defaultSchema); tableSchema != nil {
+			h.put(pos, tableSchema.Schema, tableSchema.Table, tableSchema)
+			changed = append(changed, snapshotKey(tableSchema.Schema, tableSchema.Table))
+		}
+
+	case *ast.DropTableStmt:
+		if stmt.IsView {
+			return nil, nil
+		}
+		for _, name := range stmt.Tables {
+			schema, table := tableNameOf(name, defaultSchema)
+			h.put(pos, schema, table, nil)
+			changed = append(changed, snapshotKey(schema, table))
+		}
+
+	case *ast.DropDatabaseStmt:
+		h.dropped[stmt.Name] = pos
+		for key, versions := range h.versions {
+			if strings.HasPrefix(key, stmt.Name+".") && versions[len(versions)-1].table != nil {
+				table := versions[len(versions)-1].table
+				h.put(pos, table.Schema, table.Table, nil)
+				changed = append(changed, key)
+			}
+		}
+
+	case *ast.RenameTableStmt:
+		for _, t2t := range stmt.TableToTables {
+			changed = append(changed, h.renameTable(pos, defaultSchema, t2t.OldTable, t2t.NewTable)...)
+		}
+
+	case *ast.CreateIndexStmt:
+		if stmt.KeyType != ast.IndexKeyTypeUnique {
+			return nil, nil
+		}
+		schema, table := tableNameOf(stmt.Table, defaultSchema)
+		tableSchema := h.editable(schema, table)
+		if tableSchema == nil {
+			return nil, nil
+		}
+		tableSchema.addConstraint(&ast.Constraint{
+			Tp:   ast.ConstraintUniqIndex,
+			Name: stmt.IndexName,
+			Keys: stmt.IndexPartSpecifications,
+		})
+		h.put(pos, schema, table, tableSchema)
+		changed = append(changed, snapshotKey(schema, table))
+
+	case *ast.DropIndexStmt:
+		schema, table := tableNameOf(stmt.Table, defaultSchema)
+		tableSchema := h.editable(schema, table)
+		if tableSchema == nil {
+			return nil, nil
+		}
+		tableSchema.dropIndex(stmt.IndexName)
+		h.put(pos, schema, table, tableSchema)
+		changed = append(changed, snapshotKey(schema, table))
+
+	case *ast.AlterTableStmt:
+		return h.alterTable(pos, defaultSchema, stmt)
+	}
+	return changed, nil
+}
+
+func (h *SchemaHistory) renameTable(pos BinlogPosition, defaultSchema string, oldName, newName *ast.TableName) []string {
+	oldSchema, oldTable := tableNameOf(oldName, defaultSchema)
+	newSchema, newTable := tableNameOf(newName, defaultSchema)
+	tableSchema := h.editable(oldSchema, oldTable)
+	if tableSchema == nil {
+		return nil
+	}
+	tableSchema.Schema, tableSchema.Table = newSchema, newTable
+	h.put(pos, oldSchema, oldTable, nil)
+	h.put(pos, newSchema, newTable, tableSchema)
+	return []string{snapshotKey(oldSchema, oldTable), snapshotKey(newSchema, newTable)}
+}
+
+func (h *SchemaHistory) alterTable(pos BinlogPosition, defaultSchema string, stmt *ast.AlterTableStmt) ([]string, error) {
+	schema, table := tableNameOf(stmt.Table, defaultSchema)
+	tableSchema := h.editable(schema, table)
+	if tableSchema == nil {
+		return nil, nil
+	}
+
+	var renameTo *ast.TableName
+	for _, spec := range stmt.Specs {
+		var err error
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, def := range spec.NewColumns {
+				if spec.IfNotExists && tableSchema.columnIndex(def.Name.Name.O) != -1 {
+					continue
+				}
+				if err = tableSchema.insertColumn(columnFromDef(def), spec.Position); err != nil {
+					break
+				}
+				tableSchema.addColumnKeys(def)
+			}
+			for _, constraint := range spec.NewConstraints {
+				tableSchema.addConstraint(constraint)
+			}
+		case ast.AlterTableDropColumn:
+			if spec.IfExists && tableSchema.columnIndex(spec.OldColumnName.Name.O) == -1 {
+				continue
+			}
+			err = tableSchema.removeColumn(spec.OldColumnName.Name.O)
+		case ast.AlterTableModifyColumn:
+			def := spec.NewColumns[0]
+			err = tableSchema.replaceColumn(def.Name.Name.O, def, spec.Position)
+		case ast.AlterTableChangeColumn:
+			err = tableSchema.replaceColumn(spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableRenameColumn:
+			err = tableSchema.renameColumn(spec.OldColumnName.Name.O, spec.NewColumnName.Name.O)
+		case ast.AlterTableAddConstraint:
+			tableSchema.addConstraint(spec.Constraint)
+		case ast.AlterTableDropPrimaryKey:
+			tableSchema.PrimaryKey = nil
+		case ast.AlterTableDropIndex:
+			tableSchema.dropIndex(spec.Name)
+		case ast.AlterTableRenameIndex:
+			tableSchema.renameIndex(spec.FromKey.O, spec.ToKey.O)
+		case ast.AlterTableRenameTable:
+			renameTo = spec.NewTable
+		}
+		// 起点的表结构与binlog不一致, 继续重放会得到错误的字段
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if renameTo != nil {
+		newSchema, newTable := tableNameOf(renameTo, defaultSchema)
+		tableSchema.Schema, tableSchema.Table = newSchema, newTable
+		h.put(pos, schema, table, nil)
+		h.put(pos, newSchema, newTable, tableSchema)
+		return []string{snapshotKey(schema, table), snapshotKey(newSchema, newTable)}, nil
+	}
+	h.put(pos, schema, table, tableSchema)
+	return []string{snapshotKey(schema, table)}, nil
+}
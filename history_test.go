@@ -0,0 +1,185 @@
+package mysql_flashback
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testHistoryBase() *SchemaSnapshot {
+	snapshot := NewSchemaSnapshot()
+	snapshot.Put(&TableSchema{
+		Schema: "shop",
+		Table:  "t",
+		Columns: []*Column{
+			{Name: "id", DataType: "int"},
+			{Name: "name", DataType: "varchar", Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+	})
+	return snapshot
+}
+
+func columnNames(tableSchema *TableSchema) []string {
+	names := make([]string, 0, len(tableSchema.Columns))
+	for _, column := range tableSchema.Columns {
+		names = append(names, column.Name)
+	}
+	return names
+}
+
+func TestSchemaHistoryApply(t *testing.T) {
+	before := BinlogPosition{File: "mysql-bin.000009", Pos: 4}
+	after := BinlogPosition{File: "mysql-bin.000011", Pos: 4}
+	tests := []struct {
+		name        string
+		queries     []string
+		table       string
+		wantChanged []string
+		want        []string // after处表的列, 为nil表示表不存在
+		wantKey     []string
+		wantErr     bool
+	}{
+		{
+			name:        "add column after",
+			queries:     []string{"ALTER TABLE t ADD COLUMN c int AFTER id"},
+			table:       "t",
+			wantChanged: []string{"shop.t"},
+			want:        []string{"id", "c", "name"},
+			wantKey:     []string{"id"},
+		},
+		{
+			name:        "add column first and drop",
+			queries:     []string{"ALTER TABLE shop.t ADD COLUMN c int FIRST, DROP COLUMN name"},
+			table:       "t",
+			wantChanged: []string{"shop.t"},
+			want:        []string{"c", "id"},
+			wantKey:     []string{"id"},
+		},
+		{
+			name:        "rename column",
+			queries:     []string{"ALTER TABLE t RENAME COLUMN id TO uid", "ALTER TABLE t CHANGE name title varchar(10)"},
+			table:       "t",
+			wantChanged: []string{"shop.t", "shop.t"},
+			want:        []string{"uid", "title"},
+			wantKey:     []string{"uid"},
+		},
+		{
+			name:        "rename table",
+			queries:     []string{"RENAME TABLE t TO t2"},
+			table:       "t2",
+			wantChanged: []string{"shop.t", "shop.t2"},
+			want:        []string{"id", "name"},
+			wantKey:     []string{"id"},
+		},
+		{
+			name:        "drop table",
+			queries:     []string{"DROP TABLE t"},
+			table:       "t",
+			wantChanged: []string{"shop.t"},
+		},
+		{
+			name:        "create table",
+			queries:     []string{"CREATE TABLE u (a int NOT NULL, b varchar(10), UNIQUE KEY uk (a))"},
+			table:       "u",
+			wantChanged: []string{"shop.u"},
+			want:        []string{"a", "b"},
+			wantKey:     []string{"a"},
+		},
+		{
+			name:    "if not exists and if exists",
+			queries: []string{"ALTER TABLE t ADD COLUMN IF NOT EXISTS name int, DROP COLUMN IF EXISTS x"},
+			table:   "t",
+			// 没有变化也记录一个版本
+			wantChanged: []string{"shop.t"},
+			want:        []string{"id", "name"},
+			wantKey:     []string{"id"},
+		},
+		{
+			name:    "dml is ignored",
+			queries: []string{"BEGIN", "INSERT INTO t VALUES (1, 'a')"},
+			table:   "t",
+			want:    []string{"id", "name"},
+			wantKey: []string{"id"},
+		},
+		{
+			name:    "add existing column",
+			queries: []string{"ALTER TABLE t ADD COLUMN name int"},
+			wantErr: true,
+		},
+		{
+			name:    "drop missing column",
+			queries: []string{"ALTER TABLE t DROP COLUMN x"},
+			wantErr: true,
+		},
+		{
+			name:    "rename to existing column",
+			queries: []string{"ALTER TABLE t RENAME COLUMN id TO name"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewSchemaHistory(testHistoryBase())
+			var changed []string
+			for i, query := range tt.queries {
+				pos := BinlogPosition{File: "mysql-bin.000010", Pos: uint32(100 * (i + 1))}
+				keys, err := h.Apply(pos, "shop", query)
+				if err != nil {
+					if !tt.wantErr {
+						t.Fatalf("Apply(%q) error = %v", query, err)
+					}
+					return
+				}
+				changed = append(changed, keys...)
+			}
+			if tt.wantErr {
+				t.Fatalf("Apply() error = nil, want error")
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+
+			// DDL之前的位置使用起点的表结构
+			if base, err := h.TableSchemaAt("shop", "t", before); err != nil || !reflect.DeepEqual(columnNames(base), []string{"id", "name"}) {
+				t.Errorf("TableSchemaAt(before) = %v, %v", base, err)
+			}
+
+			got, err := h.TableSchemaAt("shop", tt.table, after)
+			if tt.want == nil {
+				if !errors.Is(err, ErrTableMetadataMissing) {
+					t.Errorf("TableSchemaAt() error = %v, want %v", err, ErrTableMetadataMissing)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TableSchemaAt() error = %v", err)
+			}
+			if names := columnNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("columns = %v, want %v", names, tt.want)
+			}
+			if !reflect.DeepEqual(got.keyColumns(), tt.wantKey) {
+				t.Errorf("key = %v, want %v", got.keyColumns(), tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestBinlogPositionLess(t *testing.T) {
+	tests := []struct {
+		a, b BinlogPosition
+		want bool
+	}{
+		{BinlogPosition{"mysql-bin.000001", 100}, BinlogPosition{"mysql-bin.000001", 200}, true},
+		{BinlogPosition{"mysql-bin.000001", 200}, BinlogPosition{"mysql-bin.000001", 200}, false},
+		{BinlogPosition{"mysql-bin.000002", 4}, BinlogPosition{"mysql-bin.000001", 200}, false},
+		// 序号超过6位时按数字比较
+		{BinlogPosition{"mysql-bin.999999", 4}, BinlogPosition{"mysql-bin.1000000", 4}, true},
+		{BinlogPosition{"mysql-bin.1000000", 4}, BinlogPosition{"mysql-bin.999999", 4}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Less(tt.b); got != tt.want {
+			t.Errorf("%v.Less(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package mysql_flashback
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 通过复制协议(COM_BINLOG_DUMP)从服务端拉取binlog, 不需要访问binlog所在的文件系统.
+// 解析到开始时服务端最新的位置后自动结束, 不会一直等待新的event
+func RemoteBinlogStream(mysqlUri string, serverID uint32, binlog string, position uint32, streamFunc SteamFunc) error {
+	return RemoteBinlogStreamContext(context.Background(), mysqlUri, serverID, binlog, position, streamFunc)
+}
+
+// ctx取消时在下一个event处停止解析, 返回ctx.Err()
+func RemoteBinlogStreamContext(ctx context.Context, mysqlUri string, serverID uint32, binlog string, position uint32, streamFunc SteamFunc) error {
+	dbm, err := LinkDB(mysqlUri)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dbm.Close()
+	return remoteBinlogStream(ctx, dbm, mysqlUri, serverID, binlog, position, nil, streamFunc)
+}
+
+// skipGtids不为nil时使用COM_BINLOG_DUMP_GTID: 告诉服务端已经有binlog之前的事务和skipGtids,
+// 服务端从第一个包含其他事务的binlog开始发送, 并跳过skipGtids中的事务
+func remoteBinlogStream(ctx context.Context, dbm *DBMap, mysqlUri string, serverID uint32, binlog string, position uint32,
+	skipGtids *mysql.MysqlGTIDSet, streamFunc SteamFunc) error {
+	logs, err := filterRemoteBinlog(dbm, binlog, position)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	endFile, endPos, err := getMasterStatusFromDb(dbm.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if logs[0].name == endFile && logs[0].startPos >= endPos {
+		return nil // 没有新的event
+	}
+
+	syncer, err := newBinlogSyncer(mysqlUri, serverID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer syncer.Close()
+
+	startPos := logs[0].startPos
+	if startPos < 4 {
+		startPos = 4 // 跳过binlog文件头的magic number
+	}
+	var streamer *replication.BinlogStreamer
+	if skipGtids != nil {
+		executed, err := getPreviousGtidsFromDb(dbm.db, logs[0].name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := executed.Add(*skipGtids); err != nil {
+			return errors.Trace(err)
+		}
+		streamer, err = syncer.StartSyncGTID(executed)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		streamer, err = syncer.StartSync(mysql.Position{Name: logs[0].name, Pos: startPos})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	allLogs := make(map[string]*BinlogInfo, len(logs))
+	for _, log := range logs {
+		allLogs[log.name] = log
+	}
+	current := logs[0]
+
+	for {
+		e, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// 切换文件时服务端会先发送ROTATE_EVENT
+		if e.Header.EventType == replication.ROTATE_EVENT {
+			rotateEvent := e.Event.(*replication.RotateEvent)
+			name := string(rotateEvent.NextLogName)
+			log, ok := allLogs[name]
+			if !ok {
+				log = &BinlogInfo{name: name, path: name}
+				allLogs[name] = log
+			}
+			current = log
+		}
+		// COM_BINLOG_DUMP_GTID从文件开头发送, 跳过开始位置之前的event
+		if skipGtids != nil && current == logs[0] && e.Header.LogPos != 0 && e.Header.LogPos-e.Header.EventSize < startPos {
+			continue
+		}
+
+		if err := streamFunc(dbm, current, e); err != nil {
+			if err == StopError {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+
+		// ROTATE_EVENT为fake event时LogPos为0
+		if current.name == endFile && e.Header.LogPos >= endPos {
+			return nil
+		}
+	}
+}
+
+// 远程模式下binlog的path即为name
+func filterRemoteBinlog(DBMap *DBMap, binlog string, position uint32) ([]*BinlogInfo, error) {
+	logs, err := getBinlogFromDb(DBMap.db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return selectBinlog(logs, "", path.Base(binlog), position)
+}
+
+func newBinlogSyncer(mysqlUri string, serverID uint32) (*replication.BinlogSyncer, error) {
+	cfg, err := driver.ParseDSN(mysqlUri)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:   serverID,
+		Flavor:     mysql.MySQLFlavor,
+		Host:       host,
+		Port:       uint16(p),
+		User:       cfg.User,
+		Password:   cfg.Passwd,
+		UseDecimal: true,
+		// 同parseFile, TIMESTAMP按UTC输出
+		TimestampStringLocation: time.UTC,
+	})
+	return syncer, nil
+}
+
+// binlog开头的PREVIOUS_GTIDS_EVENT: 该文件之前所有的事务. 没有开启gtid时为空集合
+func getPreviousGtidsFromDb(db *sql.DB, file string) (*mysql.MysqlGTIDSet, error) {
+	query := fmt.Sprintf("SHOW BINLOG EVENTS IN '%s' LIMIT 2;", strings.ReplaceAll(file, "'", "''"))
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var previous string
+	var logName, pos, eventType, serverID, endLogPos, info sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&logName, &pos, &eventType, &serverID, &endLogPos, &info); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if eventType.String == "Previous_gtids" {
+			// 多个uuid之间为 ",\n"
+			previous = strings.ReplaceAll(info.String, "\n", "")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseGtidSet(previous)
+}
+
+// SHOW MASTER STATUS 的列数随版本变化, 只取前两列
+func getMasterStatusFromDb(db *sql.DB) (file string, pos uint32, err error) {
+	rows, err := db.Query("SHOW MASTER STATUS;")
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", 0, errors.Trace(err)
+		}
+		p, err := strconv.ParseUint(string(values[1]), 10, 32)
+		if err != nil {
+			return "", 0, errors.Trace(err)
+		}
+		file, pos = string(values[0]), uint32(p)
+	}
+	if file == "" {
+		return "", 0, errors.New("binlog is not enabled")
+	}
+	return file, pos, nil
+}
@@ -0,0 +1,200 @@
+package mysql_flashback
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/server"
+)
+
+// 只实现远程模式用到的查询和复制命令
+type testReplicationServer struct {
+	server.EmptyReplicationHandler
+	binlog   *testBinlog
+	previous string // 文件开头的Previous_gtids
+
+	mu       sync.Mutex
+	dumpPos  *gomysql.Position
+	dumpGtid *gomysql.MysqlGTIDSet
+}
+
+func (s *testReplicationServer) UseDB(string) error {
+	return nil
+}
+
+func (s *testReplicationServer) HandleQuery(query string) (*gomysql.Result, error) {
+	var names []string
+	var values [][]interface{}
+	switch query = strings.ToUpper(query); {
+	case strings.HasPrefix(query, "SHOW MASTER LOGS"):
+		names = []string{"Log_name", "File_size"}
+		values = [][]interface{}{{"mysql-bin.000001", strconv.Itoa(int(s.binlog.pos))}}
+	case strings.HasPrefix(query, "SHOW MASTER STATUS"):
+		names = []string{"File", "Position"}
+		values = [][]interface{}{{"mysql-bin.000001", strconv.Itoa(int(s.binlog.pos))}}
+	case strings.HasPrefix(query, "SHOW BINLOG EVENTS"):
+		names = []string{"Log_name", "Pos", "Event_type", "Server_id", "End_log_pos", "Info"}
+		values = [][]interface{}{
+			{"mysql-bin.000001", "4", "Format_desc", "1", "123", "Server ver: 5.7.30-log, Binlog ver: 4"},
+			{"mysql-bin.000001", "123", "Previous_gtids", "1", "154", s.previous},
+		}
+	case strings.HasPrefix(query, "SHOW GLOBAL VARIABLES LIKE 'BINLOG_CHECKSUM'"):
+		names = []string{"Variable_name", "Value"}
+		values = [][]interface{}{{"binlog_checksum", "NONE"}}
+	default:
+		return &gomysql.Result{}, nil
+	}
+	rs, err := gomysql.BuildSimpleTextResultset(names, values)
+	if err != nil {
+		return nil, err
+	}
+	return &gomysql.Result{Resultset: rs}, nil
+}
+
+func (s *testReplicationServer) HandleRegisterSlave([]byte) error {
+	return nil
+}
+
+func (s *testReplicationServer) HandleBinlogDump(pos gomysql.Position) (*replication.BinlogStreamer, error) {
+	s.mu.Lock()
+	s.dumpPos = &pos
+	s.mu.Unlock()
+	return s.streamer(pos.Pos)
+}
+
+func (s *testReplicationServer) HandleBinlogDumpGTID(set *gomysql.MysqlGTIDSet) (*replication.BinlogStreamer, error) {
+	s.mu.Lock()
+	s.dumpGtid = set
+	s.mu.Unlock()
+	return s.streamer(4)
+}
+
+// 同mysql, 先发送FORMAT_DESCRIPTION_EVENT, 再发送从pos开始的event. gtid模式从文件开头发送, 由客户端过滤
+func (s *testReplicationServer) streamer(pos uint32) (*replication.BinlogStreamer, error) {
+	streamer := replication.NewBinlogStreamer()
+	for i, raw := range s.binlog.events {
+		end, size := binary.LittleEndian.Uint32(raw[13:]), binary.LittleEndian.Uint32(raw[9:])
+		if i != 0 && end-size < pos {
+			continue
+		}
+		if err := streamer.AddEventToStreamer(&replication.BinlogEvent{RawData: raw}); err != nil {
+			return nil, err
+		}
+	}
+	return streamer, nil
+}
+
+// 在本地端口启动mysql协议的服务端, 返回连接的dsn
+func listenTestServer(t *testing.T, handler server.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := server.NewConn(c, "root", "root", handler)
+				if err != nil {
+					return
+				}
+				for conn.HandleCommand() == nil {
+				}
+			}()
+		}
+	}()
+	return "root:root@tcp(" + l.Addr().String() + ")/"
+}
+
+func TestRemoteBinlogStream(t *testing.T) {
+	binlog := newTestBinlog()
+	binlog.tx(1)
+	second := binlog.tx(2)
+	binlog.tx(3)
+
+	tests := []struct {
+		name      string
+		previous  string
+		position  uint32
+		gtid      bool
+		skipGtids string
+		wantDump  string // COM_BINLOG_DUMP_GTID的gtid集合
+		wantGnos  []int64
+	}{
+		{name: "position", wantGnos: []int64{1, 2, 3}},
+		{name: "position from second tx", position: second, wantGnos: []int64{2, 3}},
+		{name: "gtid", gtid: true, wantGnos: []int64{1, 2, 3}},
+		{
+			name:      "gtid skip before include",
+			previous:  "3e11fa47-71ca-11e1-9e33-c80aa9429562:1",
+			position:  second,
+			gtid:      true,
+			skipGtids: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2",
+			wantDump:  "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2",
+			wantGnos:  []int64{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testReplicationServer{binlog: binlog, previous: tt.previous}
+			uri := listenTestServer(t, s)
+			dbm, err := LinkDB(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbm.Close()
+
+			var skipGtids *gomysql.MysqlGTIDSet
+			if tt.gtid {
+				if skipGtids, err = parseGtidSet(tt.skipGtids); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var gnos []int64
+			err = remoteBinlogStream(context.Background(), dbm, uri, 1001, "mysql-bin.000001", tt.position, skipGtids,
+				func(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+					if e.Header.EventType == replication.GTID_EVENT {
+						gnos = append(gnos, e.Event.(*replication.GTIDEvent).GNO)
+					}
+					return nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if skipGtids == nil {
+				if s.dumpPos == nil || s.dumpGtid != nil {
+					t.Fatalf("want COM_BINLOG_DUMP, got position %v, gtid %v", s.dumpPos, s.dumpGtid)
+				}
+			} else {
+				if s.dumpGtid == nil || s.dumpPos != nil {
+					t.Fatalf("want COM_BINLOG_DUMP_GTID, got position %v, gtid %v", s.dumpPos, s.dumpGtid)
+				}
+				if got := s.dumpGtid.String(); got != tt.wantDump {
+					t.Errorf("dump gtid set = %q, want %q", got, tt.wantDump)
+				}
+			}
+			if len(gnos) != len(tt.wantGnos) {
+				t.Fatalf("gnos = %v, want %v", gnos, tt.wantGnos)
+			}
+			for i := range gnos {
+				if gnos[i] != tt.wantGnos[i] {
+					t.Fatalf("gnos = %v, want %v", gnos, tt.wantGnos)
+				}
+			}
+		})
+	}
+}
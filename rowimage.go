@@ -0,0 +1,107 @@
+package mysql_flashback
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"strings"
+)
+
+// binlog_row_image为MINIMAL或NOBLOB时, ROWS_EVENT中的行只包含部分列.
+// go-mysql按列的序号解码, 没有记录的列在行中为nil, 需要根据ColumnBitmap1/ColumnBitmap2区分NULL和没有记录.
+// 为nil表示包含全部列(FULL)
+type columnPresence []byte
+
+func (p columnPresence) has(idx int) bool {
+	if p == nil {
+		return true
+	}
+	return idx/8 < len(p) && p[idx/8]&(1<<uint(idx%8)) != 0
+}
+
+// 第i行包含的列. UPDATE的Rows[2n]使用ColumnBitmap1, Rows[2n+1]使用ColumnBitmap2
+func rowPresence(rowsEvent *replication.RowsEvent, i int) columnPresence {
+	bitmap := rowsEvent.ColumnBitmap1
+	if rowsEvent.ColumnBitmap2 != nil && i%2 == 1 {
+		bitmap = rowsEvent.ColumnBitmap2
+	}
+	p := columnPresence(bitmap)
+	for idx := 0; idx < int(rowsEvent.ColumnCount); idx++ {
+		if !p.has(idx) {
+			return p
+		}
+	}
+	return nil
+}
+
+// 第i行及其包含的列. UPDATE修改后的行中没有记录的列没有被修改, 用修改前的值补全(如MINIMAL时的主键)
+func rowAt(rowsEvent *replication.RowsEvent, i int) ([]interface{}, columnPresence) {
+	row, present := rowsEvent.Rows[i], rowPresence(rowsEvent, i)
+	if present == nil || rowsEvent.ColumnBitmap2 == nil || i%2 == 0 {
+		return row, present
+	}
+
+	before, beforePresent := rowsEvent.Rows[i-1], rowPresence(rowsEvent, i-1)
+	full := make([]interface{}, len(row))
+	merged := make(columnPresence, len(present))
+	copy(full, row)
+	for idx := range full {
+		switch {
+		case present.has(idx):
+		case beforePresent.has(idx) && idx < len(before):
+			full[idx] = before[idx]
+		default:
+			continue
+		}
+		merged[idx/8] |= 1 << uint(idx%8)
+	}
+	for idx := range full {
+		if !merged.has(idx) {
+			return full, merged
+		}
+	}
+	return full, nil
+}
+
+// 回滚需要修改前完整的行: DELETE回滚为INSERT需要全部列, UPDATE回滚需要被修改的列在修改前的值.
+// 否则生成的sql会丢失数据, 返回没有记录的列
+func missingRollbackColumns(tableMetadata *TableMetadata, e *replication.BinlogEvent) []string {
+	rowsEvent := e.Event.(*replication.RowsEvent)
+	missing := make(map[int]struct{})
+	switch e.Header.EventType {
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		for i, row := range rowsEvent.Rows {
+			present := rowPresence(rowsEvent, i)
+			for idx := range row {
+				if !present.has(idx) {
+					missing[idx] = struct{}{}
+				}
+			}
+		}
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		for i := 0; i+1 < len(rowsEvent.Rows); i += 2 {
+			before, after := rowPresence(rowsEvent, i), rowPresence(rowsEvent, i+1)
+			for idx := range rowsEvent.Rows[i+1] {
+				if after.has(idx) && !before.has(idx) {
+					missing[idx] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var columns []string
+	for idx := 0; idx < int(rowsEvent.ColumnCount); idx++ {
+		if _, ok := missing[idx]; ok {
+			columns = append(columns, tableMetadata.Fields[idx])
+		}
+	}
+	return columns
+}
+
+func checkRollbackImage(tableMetadata *TableMetadata, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+	if missing := missingRollbackColumns(tableMetadata, e); len(missing) != 0 {
+		return fmt.Errorf("%w: %s %s.%s, binlog: %s, pos: %d, missing columns: %s",
+			ErrIncompleteRowImage, rowsEventType(e.Header.EventType), tableMetadata.Schema, tableMetadata.Table,
+			binlog.name, e.Header.LogPos-e.Header.EventSize, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package mysql_flashback
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// id int, name varchar, content blob
+var testRowImageMetadata = &TableMetadata{
+	Schema: "shop",
+	Table:  "t",
+	Fields: map[int]string{0: "id", 1: "name", 2: "content"},
+	Columns: map[int]*Column{
+		0: {Name: "id", DataType: "int"},
+		1: {Name: "name", DataType: "varchar", Nullable: true},
+		2: {Name: "content", DataType: "blob", Nullable: true},
+	},
+	Keys: []int{0},
+}
+
+func testRowsEvent(typ replication.EventType, bitmap1, bitmap2 []byte, rows ...[]interface{}) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: typ},
+		Event: &replication.RowsEvent{
+			ColumnCount:   3,
+			ColumnBitmap1: bitmap1,
+			ColumnBitmap2: bitmap2,
+			Rows:          rows,
+		},
+	}
+}
+
+func TestRowAt(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       *replication.BinlogEvent
+		i           int
+		wantRow     []interface{}
+		wantPresent columnPresence
+	}{
+		{
+			name:    "full",
+			event:   testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x07}, []byte{0x07}, []interface{}{int32(1), "a", "x"}, []interface{}{int32(1), "b", "x"}),
+			i:       1,
+			wantRow: []interface{}{int32(1), "b", "x"},
+		},
+		{
+			name:        "minimal before",
+			event:       testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x01}, []byte{0x02}, []interface{}{int32(1), nil, nil}, []interface{}{nil, "b", nil}),
+			i:           0,
+			wantRow:     []interface{}{int32(1), nil, nil},
+			wantPresent: columnPresence{0x01},
+		},
+		{
+			// 修改后的行没有记录主键, 用修改前的值补全
+			name:        "minimal after",
+			event:       testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x01}, []byte{0x02}, []interface{}{int32(1), nil, nil}, []interface{}{nil, "b", nil}),
+			i:           1,
+			wantRow:     []interface{}{int32(1), "b", nil},
+			wantPresent: columnPresence{0x03},
+		},
+		{
+			name:    "minimal after with all columns",
+			event:   testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x05}, []byte{0x02}, []interface{}{int32(1), nil, "x"}, []interface{}{nil, "b", nil}),
+			i:       1,
+			wantRow: []interface{}{int32(1), "b", "x"},
+		},
+		{
+			name:        "noblob delete",
+			event:       testRowsEvent(replication.DELETE_ROWS_EVENTv2, []byte{0x03}, nil, []interface{}{int32(1), "a", nil}),
+			i:           0,
+			wantRow:     []interface{}{int32(1), "a", nil},
+			wantPresent: columnPresence{0x03},
+		},
+		{
+			name:        "minimal insert keeps null",
+			event:       testRowsEvent(replication.WRITE_ROWS_EVENTv2, []byte{0x03}, nil, []interface{}{int32(1), nil, nil}),
+			i:           0,
+			wantRow:     []interface{}{int32(1), nil, nil},
+			wantPresent: columnPresence{0x03},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row, present := rowAt(tt.event.Event.(*replication.RowsEvent), tt.i)
+			if !reflect.DeepEqual(row, tt.wantRow) {
+				t.Errorf("row = %v, want %v", row, tt.wantRow)
+			}
+			if !reflect.DeepEqual(present, tt.wantPresent) {
+				t.Errorf("present = %v, want %v", present, tt.wantPresent)
+			}
+		})
+	}
+}
+
+func TestMissingRollbackColumns(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *replication.BinlogEvent
+		want  []string
+	}{
+		{
+			name:  "full delete",
+			event: testRowsEvent(replication.DELETE_ROWS_EVENTv2, []byte{0x07}, nil, []interface{}{int32(1), "a", "x"}),
+		},
+		{
+			name:  "minimal delete",
+			event: testRowsEvent(replication.DELETE_ROWS_EVENTv2, []byte{0x01}, nil, []interface{}{int32(1), nil, nil}),
+			want:  []string{"name", "content"},
+		},
+		{
+			name:  "noblob delete",
+			event: testRowsEvent(replication.DELETE_ROWS_EVENTv1, []byte{0x03}, nil, []interface{}{int32(1), "a", nil}),
+			want:  []string{"content"},
+		},
+		{
+			name:  "minimal update",
+			event: testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x01}, []byte{0x02}, []interface{}{int32(1), nil, nil}, []interface{}{nil, "b", nil}),
+			want:  []string{"name"},
+		},
+		{
+			// 没有修改blob时修改前后都不记录, 回滚不需要
+			name:  "noblob update without blob",
+			event: testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x03}, []byte{0x03}, []interface{}{int32(1), "a", nil}, []interface{}{int32(1), "b", nil}),
+		},
+		{
+			name:  "noblob update with blob",
+			event: testRowsEvent(replication.UPDATE_ROWS_EVENTv2, []byte{0x03}, []byte{0x07}, []interface{}{int32(1), "a", nil}, []interface{}{int32(1), "a", "y"}),
+			want:  []string{"content"},
+		},
+		{
+			// INSERT回滚为DELETE, 只需要键
+			name:  "minimal insert",
+			event: testRowsEvent(replication.WRITE_ROWS_EVENTv2, []byte{0x01}, nil, []interface{}{int32(1), nil, nil}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingRollbackColumns(testRowImageMetadata, tt.event); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingRollbackColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package mysql_flashback
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 提供表结构. 默认从数据库的INFORMATION_SCHEMA读取,
+// 离线模式下可以从mysqldump --no-data文件或json快照读取
+type SchemaProvider interface {
+	// 表不存在时返回error
+	TableSchema(schema, table string) (*TableSchema, error)
+}
+
+type TableSchema struct {
+	Schema     string       `json:"schema"`
+	Table      string       `json:"table"`
+	Columns    []*Column    `json:"columns"`
+	PrimaryKey []string     `json:"primary_key,omitempty"`
+	UniqueKeys []*UniqueKey `json:"unique_keys,omitempty"`
+}
+
+type UniqueKey struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+func (t *TableSchema) Metadata() (*TableMetadata, error) {
+	fields := make(map[int]string, len(t.Columns))
+	columns := make(map[int]*Column, len(t.Columns))
+	fieldIdx := make(map[string]int, len(t.Columns))
+	for idx, column := range t.Columns {
+		fields[idx] = column.Name
+		columns[idx] = column
+		fieldIdx[strings.ToLower(column.Name)] = idx
+	}
+
+	keyColumns := t.keyColumns()
+	keys := make([]int, 0, len(keyColumns))
+	for _, column := range keyColumns {
+		idx, ok := fieldIdx[strings.ToLower(column)]
+		if !ok {
+			return nil, fmt.Errorf("key column %s not found in %s.%s", column, t.Schema, t.Table)
+		}
+		keys = append(keys, idx)
+	}
+
+	return &TableMetadata{t.Schema, t.Table, fields, columns, keys}, nil
+}
+
+// 优先返回主键, 没有主键时返回第一个所有字段都非空的唯一键
+func (t *TableSchema) keyColumns() []string {
+	if len(t.PrimaryKey) != 0 {
+		return t.PrimaryKey
+	}
+
+	nullable := make(map[string]bool, len(t.Columns))
+	for _, column := range t.Columns {
+		nullable[strings.ToLower(column.Name)] = column.Nullable
+	}
+	for _, key := range t.UniqueKeys {
+		ok := true
+		for _, column := range key.Columns {
+			if n, exist := nullable[strings.ToLower(column)]; !exist || n {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return key.Columns
+		}
+	}
+	return nil
+}
+
+// 内存中的表结构集合, 实现了SchemaProvider
+type SchemaSnapshot struct {
+	tables map[string]*TableSchema // map[schema.table]TableSchema
+}
+
+type schemaSnapshotFile struct {
+	Tables []*TableSchema `json:"tables"`
+}
+
+func NewSchemaSnapshot() *SchemaSnapshot {
+	return &SchemaSnapshot{tables: make(map[string]*TableSchema)}
+}
+
+func snapshotKey(schema, table string) string {
+	return fmt.Sprintf("%s.%s", schema, table)
+}
+
+func (s *SchemaSnapshot) TableSchema(schema, table string) (*TableSchema, error) {
+	tableSchema, ok := s.tables[snapshotKey(schema, table)]
+	if !ok {
+		return nil, fmt.Errorf("%w: table not found in schema snapshot: %s.%s", ErrTableMetadataMissing, schema, table)
+	}
+	return tableSchema, nil
+}
+
+func (s *SchemaSnapshot) Put(tableSchema *TableSchema) {
+	s.tables[snapshotKey(tableSchema.Schema, tableSchema.Table)] = tableSchema
+}
+
+func (s *SchemaSnapshot) Tables() []*TableSchema {
+	res := make([]*TableSchema, 0, len(s.tables))
+	for _, tableSchema := range s.tables {
+		res = append(res, tableSchema)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return snapshotKey(res[i].Schema, res[i].Table) < snapshotKey(res[j].Schema, res[j].Table)
+	})
+	return res
+}
+
+func (s *SchemaSnapshot) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Trace(encoder.Encode(&schemaSnapshotFile{Tables: s.Tables()}))
+}
+
+func LoadSchemaSnapshot(file string) (*SchemaSnapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var content schemaSnapshotFile
+	if err := json.NewDecoder(f).Decode(&content); err != nil {
+		return nil, errors.Trace(err)
+	}
+	snapshot := NewSchemaSnapshot()
+	for _, tableSchema := range content.Tables {
+		snapshot.Put(tableSchema)
+	}
+	return snapshot, nil
+}
+
+// 根据后缀选择格式: .json为json快照, 其余按mysqldump --no-data文件解析.
+// defaultSchema用于dump文件中没有USE语句的情况
+func LoadSchemaFile(file string, defaultSchema string) (*SchemaSnapshot, error) {
+	if strings.ToLower(path.Ext(file)) == ".json" {
+		return LoadSchemaSnapshot(file)
+	}
+	return LoadDumpSchema(file, defaultSchema)
+}
+
+// 从数据库导出schemas下所有表的结构
+func ExportSchemaSnapshot(db *sql.DB, schemas []string) (*SchemaSnapshot, error) {
+	snapshot := NewSchemaSnapshot()
+	for _, schema := range schemas {
+		tables, err := getTablesFromDb(db, schema)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, table := range tables {
+			tableSchema, err := getTableSchemaFromDb(db, schema, table)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			snapshot.Put(tableSchema)
+		}
+	}
+	return snapshot, nil
+}
+
+// 连接数据库导出schemas的json快照到file
+func ExportSchemaFile(mysqlUri string, schemas []string, file string) error {
+	dbm, err := LinkDB(mysqlUri)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dbm.Close()
+
+	snapshot, err := ExportSchemaSnapshot(dbm.db, schemas)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	f, err := os.OpenFile(file, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	return snapshot.WriteJSON(f)
+}
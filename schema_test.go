@@ -0,0 +1,45 @@
+package mysql_flashback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// dump文件导出为json快照后再读入, 表结构不变
+func TestSchemaSnapshotJSON(t *testing.T) {
+	snapshot, err := LoadSchemaFile("testdata/shop_nodata.sql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "schema.JSON")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.WriteJSON(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadSchemaFile(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Tables(), snapshot.Tables()) {
+		t.Errorf("tables changed after json round trip")
+	}
+	for _, tableSchema := range snapshot.Tables() {
+		want, _ := tableSchema.Metadata()
+		got, err := loaded.TableSchema(tableSchema.Schema, tableSchema.Table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tableMetadata, _ := got.Metadata(); !reflect.DeepEqual(tableMetadata, want) {
+			t.Errorf("%s.%s metadata = %+v, want %+v", tableSchema.Schema, tableSchema.Table, tableMetadata, want)
+		}
+	}
+}
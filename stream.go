@@ -1,12 +1,17 @@
 package mysql_flashback
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-mysql-org/go-mysql/replication"
 	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const StopErrorPayload = "__stop_parse_binlog__"
@@ -18,21 +23,68 @@ var StopError = fmt.Errorf(StopErrorPayload)
 type SteamFunc func(dbm *DBMap, binlog *BinlogInfo, event *replication.BinlogEvent) (err error)
 
 func BinlogStream(mysqlUri string, binlog string, position uint32, streamFunc SteamFunc) error {
+	return BinlogStreamContext(context.Background(), mysqlUri, binlog, position, streamFunc)
+}
+
+// ctx取消时在下一个event处停止解析, 返回ctx.Err()
+func BinlogStreamContext(ctx context.Context, mysqlUri string, binlog string, position uint32, streamFunc SteamFunc) error {
 	dbm, err := LinkDB(mysqlUri)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	logs, err := filterBinlog(dbm, binlog, position)
+	defer dbm.Close()
+	return localBinlogStream(ctx, dbm, binlog, position, streamFunc)
+}
+
+// 离线模式: 不连接数据库, binlog列表从binlog所在目录获取, 表结构来自provider
+func OfflineBinlogStream(provider SchemaProvider, binlog string, position uint32, streamFunc SteamFunc) error {
+	return localBinlogStream(context.Background(), NewOfflineDBMap(provider), binlog, position, streamFunc)
+}
+
+// 解析本地binlog文件. dbm没有连接数据库时, binlog列表从binlog所在目录获取
+func localBinlogStream(ctx context.Context, dbm *DBMap, binlog string, position uint32, streamFunc SteamFunc) error {
+	var logs []*BinlogInfo
+	var err error
+	if dbm.db == nil {
+		logs, err = filterLocalBinlog(binlog, position)
+	} else {
+		logs, err = filterBinlog(dbm, binlog, position)
+	}
 	if err != nil {
 		return errors.Trace(err)
 	}
+	return streamLogs(ctx, dbm, binlog, logs, streamFunc)
+}
+
+// 依次解析logs, 直到streamFunc返回StopError或解析完最后一个文件.
+// 文件末尾的ROTATE_EVENT指明了下一个文件, 与logs不一致说明中间的binlog缺失(如已被purge)
+func streamLogs(ctx context.Context, dbm *DBMap, binlog string, logs []*BinlogInfo, streamFunc SteamFunc) error {
+	var nextLog string
+	for idx, current := range logs {
+		if nextLog != "" && nextLog != current.name {
+			return fmt.Errorf("%w: %s rotate to %s, but get %s", ErrBinlogNotFound, logs[idx-1].name, nextLog, current.name)
+		}
+		if _, err := os.Stat(current.path); os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrBinlogNotFound, current.path)
+		}
 
-	for _, log := range logs {
-		if _, err := os.Stat(binlog); os.IsNotExist(err) {
+		nextLog = ""
+		stopped, err := parseFile(ctx, dbm, current, func(dbm *DBMap, binlog *BinlogInfo, event *replication.BinlogEvent) error {
+			// 文件开头的ROTATE_EVENT为fake event, LogPos为0
+			if event.Header.EventType == replication.ROTATE_EVENT && event.Header.LogPos != 0 {
+				nextLog = string(event.Event.(*replication.RotateEvent).NextLogName)
+			}
+			return streamFunc(dbm, binlog, event)
+		})
+		if err != nil {
 			return errors.Trace(err)
 		}
-		err = ParseFile(dbm, log, streamFunc)
-		return errors.Trace(err)
+		if stopped {
+			return nil
+		}
+	}
+	if nextLog != "" {
+		log.Warnf("binlog rotate to %s, but it is not found, stop at %s", nextLog, logs[len(logs)-1].name)
 	}
 	return nil
 }
@@ -43,44 +95,123 @@ func DefaultStream(mysqlUri string, path string, streamFunc SteamFunc) error {
 }
 
 func ParseFile(dbm *DBMap, log *BinlogInfo, streamFunc SteamFunc) error {
+	return ParseFileContext(context.Background(), dbm, log, streamFunc)
+}
+
+// 每个event解析前检查ctx, 取消时返回ctx.Err()
+func ParseFileContext(ctx context.Context, dbm *DBMap, log *BinlogInfo, streamFunc SteamFunc) error {
+	_, err := parseFile(ctx, dbm, log, streamFunc)
+	return errors.Trace(err)
+}
+
+// stopped: streamFunc返回了StopError
+func parseFile(ctx context.Context, dbm *DBMap, log *BinlogInfo, streamFunc SteamFunc) (stopped bool, err error) {
 	p := replication.NewBinlogParser()
-	err := p.ParseFile(log.path, int64(log.startPos), func(event *replication.BinlogEvent) error {
+	// decimal使用decimal.Decimal解码, 避免float64丢失精度
+	p.SetUseDecimal(true)
+	// TIMESTAMP按UTC输出, 与运行环境的时区无关
+	p.SetTimestampStringLocation(time.UTC)
+	var callbackErr error
+	err = p.ParseFile(log.path, int64(log.startPos), func(event *replication.BinlogEvent) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		err := streamFunc(dbm, log, event)
 		if err != nil {
 			if err == StopError {
 				return StopError
 			}
-			return errors.Trace(err)
+			callbackErr = errors.Trace(err)
+			return callbackErr
 		}
 		return nil
 	})
 	if err != nil && strings.Contains(err.Error(), StopErrorPayload) {
-		return nil
+		return true, nil
 	}
-	return errors.Trace(err)
+	// parser会包装callback返回的错误, 这里还原为ctx.Err()或callback的错误以便调用方用errors.Is判断
+	if err != nil && ctx.Err() != nil {
+		return false, errors.Trace(ctx.Err())
+	}
+	if err != nil && callbackErr != nil {
+		return false, callbackErr
+	}
+	return false, errors.Trace(err)
 }
 
 func filterBinlog(DBMap *DBMap, binlog string, position uint32) ([]*BinlogInfo, error) {
 	if _, err := os.Stat(binlog); os.IsNotExist(err) {
-		return nil, errors.Trace(err)
+		return nil, fmt.Errorf("%w: %s", ErrBinlogNotFound, binlog)
 	}
 
 	logs, err := getBinlogFromDb(DBMap.db)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return selectBinlog(logs, path.Dir(binlog), path.Base(binlog), position)
+}
+
+func filterLocalBinlog(binlog string, position uint32) ([]*BinlogInfo, error) {
+	if _, err := os.Stat(binlog); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrBinlogNotFound, binlog)
+	}
 
 	dir := path.Dir(binlog)
-	name := path.Base(binlog)
+	logs, err := getBinlogFromDir(dir, path.Base(binlog))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return selectBinlog(logs, dir, path.Base(binlog), position)
+}
+
+// 列出dir下与name同前缀的binlog(如 mysql-bin.000001), 按序号排序
+func getBinlogFromDir(dir string, name string) ([]*BinlogInfo, error) {
+	prefix := strings.TrimSuffix(name, path.Ext(name)) + "."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var result []*BinlogInfo
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(fileName, prefix) {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(fileName, prefix)); err != nil {
+			continue // mysql-bin.index 等
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		result = append(result, &BinlogInfo{
+			name:     fileName,
+			size:     uint32(info.Size()),
+			startPos: 0,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(result[i].name, prefix))
+		b, _ := strconv.Atoi(strings.TrimPrefix(result[j].name, prefix))
+		return a < b
+	})
+	return result, nil
+}
+
+// 从binlog列表中找到name, 返回name及其之后的binlog. 每个binlog的path为dir/name
+func selectBinlog(logs []*BinlogInfo, dir string, name string, position uint32) ([]*BinlogInfo, error) {
+	for _, binlog := range logs {
+		binlog.path = path.Join(dir, binlog.name)
+	}
 	for index, binlog := range logs {
-		logs[index].path = path.Join(dir, binlog.name)
 		if binlog.name == name {
 			if binlog.size < position {
-				return nil, fmt.Errorf("position err. range(0, %d), get: %d", binlog.size, position)
+				return nil, fmt.Errorf("%w: %s range(0, %d), get: %d", ErrPositionOutOfRange, name, binlog.size, position)
 			}
 			logs[index].startPos = position
 			return logs[index:], nil
 		}
 	}
-	return nil, fmt.Errorf("binlog no found: %s", binlog)
+	return nil, fmt.Errorf("%w: %s", ErrBinlogNotFound, name)
 }
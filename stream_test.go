@@ -0,0 +1,108 @@
+package mysql_flashback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// 按names依次生成binlog, 每个文件一个事务(gno从1开始), 除了最后一个文件都以ROTATE_EVENT结束
+func testBinlogFiles(t *testing.T, dir string, names []string, rotates []string) {
+	t.Helper()
+	for i, name := range names {
+		b := newTestBinlog()
+		b.tx(int64(i + 1))
+		if i < len(rotates) {
+			b.rotate(rotates[i])
+		}
+		b.save(t, dir, name)
+	}
+}
+
+func testStreamGnos(t *testing.T, dir string) ([]string, error) {
+	var gnos []string
+	err := localBinlogStream(context.Background(), NewOfflineDBMap(NewSchemaSnapshot()), filepath.Join(dir, "mysql-bin.000001"), 0,
+		func(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+			if e.Header.EventType == replication.GTID_EVENT {
+				gnos = append(gnos, fmt.Sprintf("%s:%d", binlog.name, e.Event.(*replication.GTIDEvent).GNO))
+			}
+			return nil
+		})
+	return gnos, err
+}
+
+func TestStreamLogsRotate(t *testing.T) {
+	dir := t.TempDir()
+	testBinlogFiles(t, dir,
+		[]string{"mysql-bin.000001", "mysql-bin.000002", "mysql-bin.000010"},
+		[]string{"mysql-bin.000002", "mysql-bin.000010"})
+	gnos, err := testStreamGnos(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mysql-bin.000001:1", "mysql-bin.000002:2", "mysql-bin.000010:3"}
+	if !reflect.DeepEqual(gnos, want) {
+		t.Errorf("gnos = %v, want %v", gnos, want)
+	}
+}
+
+// ROTATE_EVENT指向的文件缺失(如已被purge)时报错, 不跳过中间的binlog
+func TestStreamLogsGap(t *testing.T) {
+	dir := t.TempDir()
+	testBinlogFiles(t, dir,
+		[]string{"mysql-bin.000001", "mysql-bin.000003"},
+		[]string{"mysql-bin.000002"})
+	gnos, err := testStreamGnos(t, dir)
+	if !errors.Is(err, ErrBinlogNotFound) {
+		t.Fatalf("error = %v, want %v", err, ErrBinlogNotFound)
+	}
+	if !strings.Contains(err.Error(), "mysql-bin.000001 rotate to mysql-bin.000002, but get mysql-bin.000003") {
+		t.Errorf("error = %v", err)
+	}
+	if want := []string{"mysql-bin.000001:1"}; !reflect.DeepEqual(gnos, want) {
+		t.Errorf("gnos = %v, want %v", gnos, want)
+	}
+}
+
+// start-file和stop-file的路径写法不同时, 仍然按同一个文件处理start-pos和stop-pos
+func TestFlashbackUnnormalizedStartFile(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestBinlog()
+	var start, stop uint32
+	for gno := int64(1); gno <= 3; gno++ {
+		if gno == 2 {
+			start = b.pos
+		}
+		b.begin(gno)
+		b.tableMap(1, "t")
+		b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(gno), "a"})
+		b.commit(uint64(gno))
+		if gno == 2 {
+			stop = b.pos
+		}
+	}
+	b.save(t, dir, "mysql-bin.000001")
+
+	// 只解析第2个事务
+	cfg := testOfflineConfig(t, dir)
+	cfg.StartFile = dir + "/./mysql-bin.000001"
+	cfg.StopFile = "mysql-bin.000001"
+	cfg.StartPos, cfg.StopPos = start, stop
+	_, output, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range testInsertID.FindAllStringSubmatch(output, -1) {
+		ids = append(ids, m[1])
+	}
+	if want := []string{"2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+}
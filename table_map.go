@@ -0,0 +1,119 @@
+package mysql_flashback
+
+import (
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// binary字符集的collation id
+const binaryCollationID = 63
+
+// binlog_row_metadata=FULL(MySQL 8.0.1+)时, TABLE_MAP_EVENT中带有字段名、主键、unsigned等信息,
+// 此时不需要再去数据库查询表结构. 没有字段名时返回false.
+// event中只有主键没有唯一键, 没有主键的表无法像从数据库读取时那样退回到非空唯一键, WHERE使用整行
+func tableSchemaFromEvent(e *replication.TableMapEvent) (*TableSchema, bool) {
+	names := e.ColumnNameString()
+	if len(names) == 0 || len(names) != int(e.ColumnCount) {
+		return nil, false
+	}
+
+	unsignedMap := e.UnsignedMap()
+	collationMap := e.CollationMap()
+	enumMap := e.EnumStrValueMap()
+	setMap := e.SetStrValueMap()
+
+	tableSchema := &TableSchema{
+		Schema:  string(e.Schema),
+		Table:   string(e.Table),
+		Columns: make([]*Column, len(names)),
+	}
+	for i, name := range names {
+		column := &Column{
+			Name:     name,
+			DataType: binlogDataType(e, i, collationMap[i] == binaryCollationID),
+			Unsigned: unsignedMap[i],
+		}
+		if available, nullable := e.Nullable(i); available {
+			column.Nullable = nullable
+		}
+		switch column.DataType {
+		case "enum":
+			column.Elements = enumMap[i]
+		case "set":
+			column.Elements = setMap[i]
+		}
+		tableSchema.Columns[i] = column
+	}
+	for _, idx := range e.PrimaryKey {
+		if int(idx) < len(names) {
+			tableSchema.PrimaryKey = append(tableSchema.PrimaryKey, names[idx])
+		}
+	}
+	return tableSchema, true
+}
+
+// 由binlog中的字段类型推出与INFORMATION_SCHEMA.COLUMNS.DATA_TYPE一致的类型名
+func binlogDataType(e *replication.TableMapEvent, i int, binary bool) string {
+	tp := e.ColumnType[i]
+	if tp == mysql.MYSQL_TYPE_STRING {
+		// ENUM/SET在binlog中记录为STRING, 真实类型在meta的高8位
+		if realType := byte(e.ColumnMeta[i] >> 8); realType == mysql.MYSQL_TYPE_ENUM || realType == mysql.MYSQL_TYPE_SET {
+			tp = realType
+		}
+	}
+
+	switch tp {
+	case mysql.MYSQL_TYPE_TINY:
+		return "tinyint"
+	case mysql.MYSQL_TYPE_SHORT:
+		return "smallint"
+	case mysql.MYSQL_TYPE_INT24:
+		return "mediumint"
+	case mysql.MYSQL_TYPE_LONG:
+		return "int"
+	case mysql.MYSQL_TYPE_LONGLONG:
+		return "bigint"
+	case mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL:
+		return "decimal"
+	case mysql.MYSQL_TYPE_FLOAT:
+		return "float"
+	case mysql.MYSQL_TYPE_DOUBLE:
+		return "double"
+	case mysql.MYSQL_TYPE_BIT:
+		return "bit"
+	case mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIMESTAMP2:
+		return "timestamp"
+	case mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_DATETIME2:
+		return "datetime"
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE:
+		return "date"
+	case mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_TIME2:
+		return "time"
+	case mysql.MYSQL_TYPE_YEAR:
+		return "year"
+	case mysql.MYSQL_TYPE_ENUM:
+		return "enum"
+	case mysql.MYSQL_TYPE_SET:
+		return "set"
+	case mysql.MYSQL_TYPE_JSON:
+		return "json"
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		return "geometry"
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		if binary {
+			return "varbinary"
+		}
+		return "varchar"
+	case mysql.MYSQL_TYPE_STRING:
+		if binary {
+			return "binary"
+		}
+		return "char"
+	case mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
+		if binary {
+			return "blob"
+		}
+		return "text"
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package mysql_flashback
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// binlog_row_metadata=FULL时的TABLE_MAP_EVENT
+func testFullMetadataEvent() *replication.TableMapEvent {
+	names := []string{"id", "amount", "name", "hash", "code", "body", "data", "status", "tags", "location", "doc", "created_at", "tenant_id"}
+	e := &replication.TableMapEvent{
+		Schema:      []byte("shop"),
+		Table:       []byte("order"),
+		ColumnCount: uint64(len(names)),
+		ColumnType: []byte{
+			mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_LONG,
+			mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_STRING,
+			mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_BLOB,
+			mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_STRING,
+			mysql.MYSQL_TYPE_GEOMETRY, mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_DATETIME2,
+			mysql.MYSQL_TYPE_LONG,
+		},
+		ColumnMeta: []uint16{
+			0, 0,
+			80, 32, uint16(mysql.MYSQL_TYPE_STRING)<<8 | 16,
+			2, 2,
+			uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, uint16(mysql.MYSQL_TYPE_SET)<<8 | 1,
+			4, 4, 3,
+			0,
+		},
+		NullBitmap: []byte{0x24, 0x00}, // name, body可以为NULL
+		// 数值列 id, amount, tenant_id 按从高到低的bit记录: id和tenant_id为unsigned
+		SignednessBitmap: []byte{0xa0},
+		// 字符列 name, hash, code, body, data 的collation, 63为binary
+		ColumnCharset: []uint64{255, 63, 63, 45, 63},
+		EnumStrValue:  [][][]byte{{[]byte("new"), []byte("paid")}},
+		SetStrValue:   [][][]byte{{[]byte("gift"), []byte("urgent")}},
+		PrimaryKey:    []uint64{12, 0},
+	}
+	for _, name := range names {
+		e.ColumnName = append(e.ColumnName, []byte(name))
+	}
+	return e
+}
+
+func TestTableSchemaFromEvent(t *testing.T) {
+	tableSchema, ok := tableSchemaFromEvent(testFullMetadataEvent())
+	if !ok {
+		t.Fatal("full metadata not recognized")
+	}
+	want := &TableSchema{
+		Schema: "shop",
+		Table:  "order",
+		Columns: []*Column{
+			{Name: "id", DataType: "bigint", Unsigned: true},
+			{Name: "amount", DataType: "int"},
+			{Name: "name", DataType: "varchar", Nullable: true},
+			{Name: "hash", DataType: "varbinary"},
+			{Name: "code", DataType: "binary"},
+			{Name: "body", DataType: "text", Nullable: true},
+			{Name: "data", DataType: "blob"},
+			{Name: "status", DataType: "enum", Elements: []string{"new", "paid"}},
+			{Name: "tags", DataType: "set", Elements: []string{"gift", "urgent"}},
+			{Name: "location", DataType: "geometry"},
+			{Name: "doc", DataType: "json"},
+			{Name: "created_at", DataType: "datetime"},
+			{Name: "tenant_id", DataType: "int", Unsigned: true},
+		},
+		PrimaryKey: []string{"tenant_id", "id"},
+	}
+	if !reflect.DeepEqual(tableSchema, want) {
+		for i, column := range tableSchema.Columns {
+			t.Logf("column %d: %+v", i, *column)
+		}
+		t.Fatalf("table schema mismatch, primary key = %v", tableSchema.PrimaryKey)
+	}
+
+	tableMetadata, err := tableSchema.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{12, 0}; !reflect.DeepEqual(tableMetadata.Keys, want) {
+		t.Errorf("keys = %v, want %v", tableMetadata.Keys, want)
+	}
+}
+
+func TestTableSchemaFromEventWithoutMetadata(t *testing.T) {
+	// binlog_row_metadata=MINIMAL时没有字段名
+	e := testFullMetadataEvent()
+	e.ColumnName = nil
+	if _, ok := tableSchemaFromEvent(e); ok {
+		t.Errorf("event without column names should be ignored")
+	}
+
+	// 没有主键时不会退回到唯一键(event中没有唯一键)
+	e = testFullMetadataEvent()
+	e.PrimaryKey = nil
+	tableSchema, ok := tableSchemaFromEvent(e)
+	if !ok {
+		t.Fatal("full metadata not recognized")
+	}
+	tableMetadata, err := tableSchema.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tableMetadata.Keys) != 0 {
+		t.Errorf("keys = %v, want none", tableMetadata.Keys)
+	}
+}
+
+func TestBinlogDataType(t *testing.T) {
+	tests := []struct {
+		tp     byte
+		meta   uint16
+		binary bool
+		want   string
+	}{
+		{mysql.MYSQL_TYPE_TINY, 0, false, "tinyint"},
+		{mysql.MYSQL_TYPE_SHORT, 0, false, "smallint"},
+		{mysql.MYSQL_TYPE_INT24, 0, false, "mediumint"},
+		{mysql.MYSQL_TYPE_NEWDECIMAL, 0x0a02, false, "decimal"},
+		{mysql.MYSQL_TYPE_FLOAT, 4, false, "float"},
+		{mysql.MYSQL_TYPE_DOUBLE, 8, false, "double"},
+		{mysql.MYSQL_TYPE_BIT, 1, false, "bit"},
+		{mysql.MYSQL_TYPE_TIMESTAMP2, 0, false, "timestamp"},
+		{mysql.MYSQL_TYPE_DATE, 0, false, "date"},
+		{mysql.MYSQL_TYPE_TIME2, 0, false, "time"},
+		{mysql.MYSQL_TYPE_YEAR, 0, false, "year"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_STRING)<<8 | 4, false, "char"},
+		{mysql.MYSQL_TYPE_VAR_STRING, 4, true, "varbinary"},
+		// ENUM/SET的collation不影响类型
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, true, "enum"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_SET)<<8 | 1, true, "set"},
+		{mysql.MYSQL_TYPE_NULL, 0, false, ""},
+	}
+	for _, tt := range tests {
+		e := &replication.TableMapEvent{ColumnCount: 1, ColumnType: []byte{tt.tp}, ColumnMeta: []uint16{tt.meta}}
+		if got := binlogDataType(e, 0, tt.binary); got != tt.want {
+			t.Errorf("binlogDataType(%d, %#x, %v) = %q, want %q", tt.tp, tt.meta, tt.binary, got, tt.want)
+		}
+	}
+}
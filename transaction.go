@@ -0,0 +1,114 @@
+package mysql_flashback
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 按事务标识选取事务, 支持三种格式:
+//   - gtid: 3E11FA47-71CA-11E1-9E33-C80AA9429562:23
+//   - 事务开始的位置: mysql-bin.000026:259, 可以是GTID_EVENT(ANONYMOUS_GTID_EVENT)或BEGIN的位置
+//   - xid: xid:12345, 即XID_EVENT中的xid. 需要先扫描binlog找到事务开始的位置(resolveXids)
+type txSelector struct {
+	gtids     map[string]string         // map[uuid:gno]原始输入
+	positions map[BinlogPosition]string // map[file:pos]原始输入
+	xids      map[uint64]string         // map[xid]原始输入, 找到开始位置后移到positions
+	found     map[string]struct{}
+}
+
+func newTxSelector(transactions []string) (*txSelector, error) {
+	if len(transactions) == 0 {
+		return nil, nil
+	}
+	s := &txSelector{
+		gtids:     make(map[string]string),
+		positions: make(map[BinlogPosition]string),
+		xids:      make(map[uint64]string),
+		found:     make(map[string]struct{}),
+	}
+	for _, tx := range transactions {
+		tx = strings.TrimSpace(tx)
+		idx := strings.LastIndex(tx, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("transaction format is illegal: %s", tx)
+		}
+		n, err := strconv.ParseUint(tx[idx+1:], 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "transaction format is illegal: %s", tx)
+		}
+		if strings.EqualFold(tx[:idx], "xid") {
+			s.xids[n] = tx
+			continue
+		}
+		if sid, err := uuid.Parse(tx[:idx]); err == nil {
+			s.gtids[fmt.Sprintf("%s:%d", sid, n)] = tx
+			continue
+		}
+		s.positions[BinlogPosition{File: path.Base(tx[:idx]), Pos: uint32(n)}] = tx
+	}
+	return s, nil
+}
+
+// e为事务开始的GTID_EVENT/ANONYMOUS_GTID_EVENT, gtid为空表示没有开启gtid
+func (s *txSelector) match(binlog *BinlogInfo, e *replication.BinlogEvent, gtid string) bool {
+	if tx, ok := s.gtids[gtid]; ok && gtid != "" {
+		s.found[tx] = struct{}{}
+		return true
+	}
+	// GTID_EVENT之后紧跟着BEGIN, 其开始位置即为GTID_EVENT的结束位置
+	for _, pos := range []uint32{e.Header.LogPos - e.Header.EventSize, e.Header.LogPos} {
+		if tx, ok := s.positions[BinlogPosition{File: binlog.name, Pos: pos}]; ok {
+			s.found[tx] = struct{}{}
+			return true
+		}
+	}
+	return false
+}
+
+// start为xid所在事务开始的位置. 同一个xid只使用第一次出现的事务
+func (s *txSelector) resolveXid(xid uint64, start BinlogPosition) {
+	if tx, ok := s.xids[xid]; ok {
+		s.positions[start] = tx
+		delete(s.xids, xid)
+	}
+}
+
+// 复制出还没有找到任何事务的selector
+func (s *txSelector) clone() *txSelector {
+	if s == nil {
+		return nil
+	}
+	n := *s
+	n.found = make(map[string]struct{})
+	return &n
+}
+
+// 所有事务都已经找到
+func (s *txSelector) done() bool {
+	return len(s.found) == len(s.gtids)+len(s.positions)+len(s.xids)
+}
+
+func (s *txSelector) missing() []string {
+	var res []string
+	for _, tx := range s.gtids {
+		if _, ok := s.found[tx]; !ok {
+			res = append(res, tx)
+		}
+	}
+	for _, tx := range s.positions {
+		if _, ok := s.found[tx]; !ok {
+			res = append(res, tx)
+		}
+	}
+	for _, tx := range s.xids {
+		res = append(res, tx)
+	}
+	sort.Strings(res)
+	return res
+}
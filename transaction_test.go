@@ -0,0 +1,91 @@
+package mysql_flashback
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+var testInsertID = regexp.MustCompile("VALUES \\((\\d+),")
+
+func TestSelectTransactions(t *testing.T) {
+	// 每个事务插入id为gno的一行, xid为100+gno
+	b := newTestBinlog()
+	var starts, begins []uint32
+	for gno := int64(1); gno <= 4; gno++ {
+		start, begin := b.begin(gno)
+		starts, begins = append(starts, start), append(begins, begin)
+		b.tableMap(1, "t")
+		b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(gno), "a"})
+		b.commit(uint64(100 + gno))
+	}
+	dir := t.TempDir()
+	b.save(t, dir, "mysql-bin.000001")
+	gtid := testServerUUID.String()
+
+	tests := []struct {
+		name         string
+		transactions []string
+		wantIDs      []string
+		wantStop     uint32 // 全部找到后在下一个事务的GTID_EVENT处结束, 0为解析到文件末尾
+		wantMissing  bool
+	}{
+		{name: "gtid", transactions: []string{gtid + ":2"}, wantIDs: []string{"2"}, wantStop: begins[2]},
+		{name: "gtid upper case", transactions: []string{"3E11FA47-71CA-11E1-9E33-C80AA9429562:3"}, wantIDs: []string{"3"}, wantStop: begins[3]},
+		{
+			// GTID_EVENT或BEGIN的位置, 文件名可以带路径
+			name:         "position",
+			transactions: []string{fmt.Sprintf("mysql-bin.000001:%d", starts[0]), fmt.Sprintf("%s/mysql-bin.000001:%d", dir, begins[2])},
+			wantIDs:      []string{"1", "3"},
+			wantStop:     begins[3],
+		},
+		{name: "xid", transactions: []string{"xid:102", "XID:103"}, wantIDs: []string{"2", "3"}, wantStop: begins[3]},
+		{name: "last", transactions: []string{"xid:104", gtid + ":1"}, wantIDs: []string{"1", "4"}},
+		{name: "missing", transactions: []string{gtid + ":2", gtid + ":9", "xid:999"}, wantIDs: []string{"2"}, wantMissing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testOfflineConfig(t, dir)
+			cfg.Transactions = tt.transactions
+			fb, output, err := runTestFlashback(t, cfg)
+			if tt.wantMissing {
+				if !errors.Is(err, ErrTransactionNotFound) {
+					t.Fatalf("error = %v, want %v", err, ErrTransactionNotFound)
+				}
+				want := fmt.Sprintf("%s: %s:9, xid:999", ErrTransactionNotFound, gtid)
+				if err.Error() != want {
+					t.Errorf("error = %q, want %q", err, want)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, m := range testInsertID.FindAllStringSubmatch(output, -1) {
+				ids = append(ids, m[1])
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			wantStop := tt.wantStop
+			if wantStop == 0 {
+				wantStop = b.pos
+			}
+			if fb.position.Pos != wantStop {
+				t.Errorf("stopped at %d, want %d", fb.position.Pos, wantStop)
+			}
+		})
+	}
+}
+
+func TestNewTxSelectorIllegal(t *testing.T) {
+	for _, tx := range []string{"", "12345", ":1", "xid:a", "mysql-bin.000001:-1"} {
+		if _, err := newTxSelector([]string{tx}); err == nil {
+			t.Errorf("newTxSelector(%q) error = nil, want error", tx)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package mysql_flashback
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const timeLayout = "2006-01-02 15:04:05.999999"
+
+// 将binlog中解码出的值按字段类型转换为sql字面量, 保证生成的sql执行后能得到完全相同的值.
+// column为nil时(拿不到表结构), 只能根据go类型推断
+func buildSqlFieldValue(value interface{}, column *Column) string {
+	if value == nil {
+		return "NULL"
+	}
+
+	if column != nil {
+		switch column.DataType {
+		case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+			return buildIntegerValue(value, column)
+		case "bit":
+			return buildBitValue(value)
+		case "enum":
+			return buildEnumValue(value, column)
+		case "set":
+			return buildSetValue(value, column)
+		case "json":
+			// 直接和字符串比较时json列不会相等, 需要转换为json类型
+			return fmt.Sprintf("CAST(%s AS JSON)", quoteString(string(toBytes(value))))
+		}
+		// binlog中的geometry为mysql内部格式(SRID + WKB), 原样写回即可
+		if column.IsBinary() || column.IsGeometry() {
+			return buildHexValue(toBytes(value))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return quoteString(v)
+	case []byte:
+		// text, longtext
+		if column == nil {
+			return buildHexValue(v)
+		}
+		return quoteString(string(v))
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		return fmt.Sprintf("%d", v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case decimal.Decimal:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		// TIMESTAMP按UTC输出, 同生成的sql开头的SET time_zone
+		return quoteString(v.UTC().Format(timeLayout))
+	default:
+		return fmt.Sprintf("---Invalid---: '%v'", value)
+	}
+}
+
+// binlog中的整数都是按有符号解码的, unsigned字段需要还原
+func buildIntegerValue(value interface{}, column *Column) string {
+	if !column.Unsigned {
+		return fmt.Sprintf("%d", value)
+	}
+	switch v := value.(type) {
+	case int8:
+		return strconv.FormatUint(uint64(uint8(v)), 10)
+	case int16:
+		return strconv.FormatUint(uint64(uint16(v)), 10)
+	case int32:
+		if column.DataType == "mediumint" {
+			return strconv.FormatUint(uint64(uint32(v)&0xFFFFFF), 10)
+		}
+		return strconv.FormatUint(uint64(uint32(v)), 10)
+	case int64:
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+func buildBitValue(value interface{}) string {
+	v, ok := value.(int64)
+	if !ok {
+		return fmt.Sprintf("%d", value)
+	}
+	return fmt.Sprintf("b'%b'", uint64(v))
+}
+
+// binlog中的enum为成员的序号(从1开始), 0为非法值(空字符串)
+func buildEnumValue(value interface{}, column *Column) string {
+	v, ok := value.(int64)
+	if !ok {
+		return fmt.Sprintf("%v", value)
+	}
+	element, ok := enumElement(v, column)
+	if !ok {
+		return strconv.FormatInt(v, 10)
+	}
+	return quoteString(element)
+}
+
+// 序号超出成员数量时(表结构不匹配)返回false
+func enumElement(v int64, column *Column) (string, bool) {
+	if v == 0 {
+		return "", true
+	}
+	if v < 0 || int(v) > len(column.Elements) {
+		return "", false
+	}
+	return column.Elements[v-1], true
+}
+
+// binlog中的set为bitmap, 第n位代表第n个成员
+func buildSetValue(value interface{}, column *Column) string {
+	v, ok := value.(int64)
+	if !ok {
+		return fmt.Sprintf("%v", value)
+	}
+	elements, ok := setElements(v, column)
+	if !ok {
+		return strconv.FormatInt(v, 10)
+	}
+	return quoteString(elements)
+}
+
+// bitmap中有超出成员数量的位时(表结构不匹配)返回false
+func setElements(v int64, column *Column) (string, bool) {
+	if len(column.Elements) < 64 && uint64(v)>>uint(len(column.Elements)) != 0 {
+		return "", false
+	}
+	members := make([]string, 0, len(column.Elements))
+	for i, element := range column.Elements {
+		if uint64(v)&(1<<uint(i)) != 0 {
+			members = append(members, element)
+		}
+	}
+	return strings.Join(members, ","), true
+}
+
+func buildHexValue(b []byte) string {
+	return fmt.Sprintf("X'%s'", hex.EncodeToString(b))
+}
+
+func toBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return []byte(fmt.Sprintf("%v", v))
+	}
+}
+
+// 按mysql的转义规则生成字符串字面量
+func quoteString(s string) string {
+	var buf strings.Builder
+	buf.Grow(len(s) + 2)
+	buf.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			buf.WriteString(`\0`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\'':
+			buf.WriteString(`\'`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\032':
+			buf.WriteString(`\Z`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
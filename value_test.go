@@ -0,0 +1,66 @@
+package mysql_flashback
+
+import (
+	"testing"
+)
+
+func TestQuoteString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", `''`},
+		{"abc", `'abc'`},
+		{"it's", `'it\'s'`},
+		{`say "hi"`, `'say \"hi\"'`},
+		{`C:\dir`, `'C:\\dir'`},
+		{"a\nb\rc", `'a\nb\rc'`},
+		{"a\x00b", `'a\0b'`},
+		{"a\x1ab", `'a\Zb'`},
+		{"中文", `'中文'`},
+	}
+	for _, tt := range tests {
+		if got := quoteString(tt.s); got != tt.want {
+			t.Errorf("quoteString(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestBuildSqlFieldValue(t *testing.T) {
+	enum := &Column{Name: "status", DataType: "enum", Elements: []string{"new", "paid", "it's"}}
+	set := &Column{Name: "tags", DataType: "set", Elements: []string{"a", "b", "c"}}
+	bit := &Column{Name: "flags", DataType: "bit"}
+	tests := []struct {
+		name   string
+		value  interface{}
+		column *Column
+		want   string
+	}{
+		{"null", nil, enum, "NULL"},
+		{"enum", int64(2), enum, `'paid'`},
+		{"enum quoted", int64(3), enum, `'it\'s'`},
+		{"enum empty", int64(0), enum, `''`},
+		{"enum out of range", int64(4), enum, "4"},
+		{"set", int64(5), set, `'a,c'`},
+		{"set empty", int64(0), set, `''`},
+		{"set out of range", int64(8), set, "8"},
+		{"bit", int64(5), bit, "b'101'"},
+		{"bit zero", int64(0), bit, "b'0'"},
+		{"bit all", int64(-1), bit, "b'" + "1111111111111111111111111111111111111111111111111111111111111111" + "'"},
+		{"unsigned int", int32(-1), &Column{DataType: "int", Unsigned: true}, "4294967295"},
+		{"unsigned mediumint", int32(-1), &Column{DataType: "mediumint", Unsigned: true}, "16777215"},
+		{"signed tinyint", int8(-1), &Column{DataType: "tinyint"}, "-1"},
+		{"binary", []byte{0x00, 0xff}, &Column{DataType: "varbinary"}, "X'00ff'"},
+		{"geometry", []byte{0xe6, 0x10, 0x00, 0x00, 0x01}, &Column{DataType: "point"}, "X'e610000001'"},
+		{"text", []byte("a'b"), &Column{DataType: "text"}, `'a\'b'`},
+		{"json", `{"a":1}`, &Column{DataType: "json"}, `CAST('{\"a\":1}' AS JSON)`},
+		{"no column bytes", []byte("ab"), nil, "X'6162'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildSqlFieldValue(tt.value, tt.column); got != tt.want {
+				t.Errorf("buildSqlFieldValue(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package mysql_flashback
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// 回滚前行的当前状态
+const (
+	RowUnchanged = "unchanged" // 与binlog中修改后的样子相同
+	RowModified  = "modified"  // 之后被修改过(被删除的行之后又被插入也算)
+	RowMissing   = "missing"   // 之后被删除, 没有键的表被修改过也会找不到
+)
+
+// 每个表的校验结果, 按行计数
+type VerifySummary struct {
+	Schema    string
+	Table     string
+	Unchanged int
+	Modified  int
+	Missing   int
+}
+
+func (s *VerifySummary) String() string {
+	return fmt.Sprintf("`%s`.`%s` unchanged: %d, modified: %d, missing: %d", s.Schema, s.Table, s.Unchanged, s.Modified, s.Missing)
+}
+
+// binlog留下的行: 同一行被多次修改时只保留最后一次
+type expectedRow struct {
+	tableMetadata *TableMetadata
+	row           []interface{}
+	present       columnPresence // binlog_row_image不为FULL时只比较记录了的列
+	deleted       bool           // 最后一次修改为DELETE, 期望行不存在
+}
+
+type verifier struct {
+	fb    *Flashback
+	rows  map[string]*expectedRow // map[rowKey]row
+	order []string                // 行第一次出现的顺序
+}
+
+func (v *verifier) streamFunc(dbm *DBMap, binlog *BinlogInfo, e *replication.BinlogEvent) error {
+	fb := v.fb
+	if binlog.name != fb.position.File {
+		fb.skipTx = false
+		fb.dependentTx = false
+	}
+	fb.position = BinlogPosition{File: binlog.name, Pos: e.Header.LogPos}
+	if err := fb.prepare(dbm, binlog, e); err != nil {
+		return errors.Trace(err)
+	}
+	event, err := fb.filterEvent(dbm, binlog, e)
+	if err != nil {
+		return StopError
+	}
+	if event == nil || !isRowsEvent(e.Header.EventType) {
+		return nil
+	}
+
+	rowsEvent := event.Event.(*replication.RowsEvent)
+	tableMetadata, ok := dbm.LookupTableMetadata(rowsEvent.TableID)
+	if !ok {
+		return fmt.Errorf("%w: %s.%s, table id: %d", ErrTableMetadataMissing, rowsEvent.Table.Schema, rowsEvent.Table.Table, rowsEvent.TableID)
+	}
+	switch e.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		for i := range rowsEvent.Rows {
+			v.put(tableMetadata, rowsEvent, i, false)
+		}
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		// 修改了键时原来的行不应存在
+		for i := 0; i+1 < len(rowsEvent.Rows); i += 2 {
+			v.put(tableMetadata, rowsEvent, i, true)
+			v.put(tableMetadata, rowsEvent, i+1, false)
+		}
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		for i := range rowsEvent.Rows {
+			v.put(tableMetadata, rowsEvent, i, true)
+		}
+	}
+	return nil
+}
+
+func (v *verifier) put(tableMetadata *TableMetadata, rowsEvent *replication.RowsEvent, i int, deleted bool) {
+	row, present := rowAt(rowsEvent, i)
+	key := rowKey(tableMetadata, row)
+	if _, ok := v.rows[key]; !ok {
+		v.order = append(v.order, key)
+	}
+	v.rows[key] = &expectedRow{tableMetadata: tableMetadata, row: row, present: present, deleted: deleted}
+}
+
+// 按主键(没有键时为整行)查询当前的行, 在数据库中比较整行是否与binlog中的相同
+func (v *verifier) check(ctx context.Context, db *sql.DB, expected *expectedRow) (string, error) {
+	tableMetadata := expected.tableMetadata
+	present := comparablePresence(tableMetadata, expected.row, expected.present)
+	query := fmt.Sprintf("SELECT %s FROM `%s`.`%s` WHERE %s LIMIT 1",
+		orTrue(buildWhereExp(tableMetadata, expected.row, present, false)),
+		tableMetadata.Schema, tableMetadata.Table,
+		orTrue(buildWhereExp(tableMetadata, expected.row, present, true)))
+
+	var unchanged sql.NullBool
+	err := db.QueryRowContext(ctx, query).Scan(&unchanged)
+	switch {
+	case err == sql.ErrNoRows:
+		if expected.deleted {
+			return RowUnchanged, nil
+		}
+		return RowMissing, nil
+	case err != nil:
+		return "", errors.Annotate(err, query)
+	case expected.deleted || !unchanged.Bool:
+		return RowModified, nil
+	default:
+		return RowUnchanged, nil
+	}
+}
+
+// FLOAT/DOUBLE的值按sql字面量比较时可能不相等, 不参与比较(之后只修改了这些列时记为unchanged)
+func comparablePresence(tableMetadata *TableMetadata, row []interface{}, present columnPresence) columnPresence {
+	res := make(columnPresence, (len(row)+7)/8)
+	approximate := false
+	for idx := range row {
+		if column := tableMetadata.Columns[idx]; column != nil && column.IsApproximate() {
+			approximate = true
+			continue
+		}
+		if present.has(idx) {
+			res[idx/8] |= 1 << uint(idx%8)
+		}
+	}
+	if !approximate {
+		return present
+	}
+	return res
+}
+
+// 所有列都不参与比较时条件为空
+func orTrue(exp string) string {
+	if exp == "" {
+		return "TRUE"
+	}
+	return exp
+}
+
+// 校验回滚范围内的行在db中是否还是binlog修改后的样子, 返回每个表的结果, 按表第一次出现的顺序
+func (fb *Flashback) verifyRows(ctx context.Context, db *sql.DB) ([]*VerifySummary, error) {
+	v := &verifier{fb: fb.scanner(), rows: make(map[string]*expectedRow)}
+	if err := fb.stream(ctx, v.fb.dbm, v.streamFunc); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var summaries []*VerifySummary
+	tables := make(map[string]*VerifySummary)
+	for _, key := range v.order {
+		expected := v.rows[key]
+		tableKey := snapshotKey(expected.tableMetadata.Schema, expected.tableMetadata.Table)
+		summary, ok := tables[tableKey]
+		if !ok {
+			summary = &VerifySummary{Schema: expected.tableMetadata.Schema, Table: expected.tableMetadata.Table}
+			tables[tableKey] = summary
+			summaries = append(summaries, summary)
+		}
+
+		status, err := v.check(ctx, db, expected)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch status {
+		case RowUnchanged:
+			summary.Unchanged++
+		case RowModified:
+			summary.Modified++
+		case RowMissing:
+			summary.Missing++
+		}
+		if status != RowUnchanged {
+			log.Warnf("verify: %s %s", strings.TrimSpace(key), status)
+		}
+	}
+	return summaries, nil
+}
+
+// 校验ApplyDSN, 没有时校验MysqlUri上的数据
+func (fb *Flashback) checkRows(ctx context.Context) error {
+	db := fb.dbm.db
+	if fb.applyDSN != "" {
+		dsn, err := utcDSN(fb.applyDSN)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		target, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer target.Close()
+		db = target
+	}
+
+	summaries, err := fb.verifyRows(ctx, db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fb.verifySummaries = summaries
+	for _, summary := range summaries {
+		log.Infof("verify: %s", summary)
+	}
+	return nil
+}
+
+// Config.VerifyOnly: 只校验回滚范围内的行, 不输出
+func (fb *Flashback) verifyContext(ctx context.Context) error {
+	if err := fb.resolveXids(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(fb.checkRows(ctx))
+}
+
+// 回滚前的校验结果, 需要开启Config.Verify或Config.VerifyOnly
+func (fb *Flashback) VerifySummaries() []*VerifySummary {
+	return fb.verifySummaries
+}
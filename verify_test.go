@@ -0,0 +1,145 @@
+package mysql_flashback
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/server"
+)
+
+// 按results返回校验查询的结果, 没有的查询返回空结果(行不存在)
+type testVerifyServer struct {
+	server.EmptyHandler
+	results map[string]int64
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *testVerifyServer) UseDB(string) error {
+	return nil
+}
+
+func (s *testVerifyServer) HandleQuery(query string) (*gomysql.Result, error) {
+	if strings.HasPrefix(query, "SET ") {
+		return &gomysql.Result{}, nil
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+	var values [][]interface{}
+	if res, ok := s.results[query]; ok {
+		values = [][]interface{}{{res}}
+	}
+	rs, err := gomysql.BuildSimpleTextResultset([]string{"unchanged"}, values)
+	if err != nil {
+		return nil, err
+	}
+	return &gomysql.Result{Resultset: rs}, nil
+}
+
+func TestVerifyOnly(t *testing.T) {
+	b := newTestBinlog()
+	b.begin(1)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(2), "b"}, []interface{}{int32(3), "c"})
+	b.commit(1)
+	// 只比较每行最后的样子: id=1为'x', id=2应该不存在
+	b.begin(2)
+	b.tableMap(1, "t")
+	b.rows(replication.UPDATE_ROWS_EVENTv2, 1, []interface{}{int32(1), "a"}, []interface{}{int32(1), "x"})
+	b.tableMap(1, "t")
+	b.rows(replication.DELETE_ROWS_EVENTv2, 1, []interface{}{int32(2), "b"})
+	b.commit(2)
+	b.begin(3)
+	b.tableMap(1, "t")
+	b.rows(replication.WRITE_ROWS_EVENTv2, 1, []interface{}{int32(4), "d"})
+	b.commit(3)
+
+	const (
+		query1 = "SELECT `id`=1 AND `name`='x' FROM `shop`.`t` WHERE `id`=1 LIMIT 1"
+		query2 = "SELECT `id`=2 AND `name`='b' FROM `shop`.`t` WHERE `id`=2 LIMIT 1"
+		query3 = "SELECT `id`=3 AND `name`='c' FROM `shop`.`t` WHERE `id`=3 LIMIT 1"
+		query4 = "SELECT `id`=4 AND `name`='d' FROM `shop`.`t` WHERE `id`=4 LIMIT 1"
+	)
+	s := &testVerifyServer{results: map[string]int64{
+		query1: 1, // unchanged
+		query2: 1, // 被删除的行又被插入, modified
+		query3: 0, // modified
+		// id=4 missing
+	}}
+	dir := t.TempDir()
+	b.save(t, dir, "mysql-bin.000001")
+	cfg := testOfflineConfig(t, dir)
+	cfg.ApplyDSN = listenTestServer(t, s)
+	cfg.VerifyOnly = true
+	fb, _, err := runTestFlashback(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*VerifySummary{{Schema: "shop", Table: "t", Unchanged: 1, Modified: 2, Missing: 1}}
+	if got := fb.VerifySummaries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("summaries = %v, want %v", got, want)
+	}
+	if want := []string{query1, query2, query3, query4}; !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("queries = %q, want %q", s.queries, want)
+	}
+	// 只校验时不输出
+	if _, err := os.Stat(cfg.OutputFile); !os.IsNotExist(err) {
+		t.Errorf("output file exists, stat error = %v", err)
+	}
+}
+
+// FLOAT/DOUBLE不参与比较, 没有键时也不作为查询条件
+func TestVerifierCheckApproximate(t *testing.T) {
+	s := &testVerifyServer{}
+	db, err := sql.Open("mysql", listenTestServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tableMetadata := &TableMetadata{
+		Schema: "shop",
+		Table:  "p",
+		Fields: map[int]string{0: "id", 1: "price", 2: "name"},
+		Columns: map[int]*Column{
+			0: {Name: "id", DataType: "int"},
+			1: {Name: "price", DataType: "float"},
+			2: {Name: "name", DataType: "varchar"},
+		},
+		Keys: []int{0},
+	}
+	noKey := *tableMetadata
+	noKey.Keys = nil
+	row := []interface{}{int32(1), float32(1.1), "a"}
+
+	v := &verifier{}
+	for _, tt := range []struct {
+		tableMetadata *TableMetadata
+		want          string
+	}{
+		{tableMetadata, "SELECT `id`=1 AND `name`='a' FROM `shop`.`p` WHERE `id`=1 LIMIT 1"},
+		{&noKey, "SELECT `id`=1 AND `name`='a' FROM `shop`.`p` WHERE `id`=1 AND `name`='a' LIMIT 1"},
+	} {
+		s.queries = nil
+		status, err := v.check(context.Background(), db, &expectedRow{tableMetadata: tt.tableMetadata, row: row, present: columnPresence{0x07}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != RowMissing {
+			t.Errorf("status = %s, want %s", status, RowMissing)
+		}
+		if len(s.queries) != 1 || s.queries[0] != tt.want {
+			t.Errorf("queries = %q, want %q", s.queries, tt.want)
+		}
+	}
+}
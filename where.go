@@ -0,0 +1,466 @@
+package mysql_flashback
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/opcode"
+	"github.com/pingcap/tidb/parser/test_driver"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+)
+
+// 行级别的过滤条件(Config.Where), 语法同sql的WHERE, 字段名为表中的列名.
+// 在行修改前或修改后的值上求值, 有一个为真则保留该行(UPDATE的前后两行一起保留).
+// 支持: AND OR XOR NOT, = <=> != < <= > >=, IN, BETWEEN, LIKE, IS [NOT] NULL, IS [NOT] TRUE/FALSE.
+// 和数字比较时按数字比较, 否则按字符串比较(区分大小写). 表中没有的列为NULL
+type rowFilter struct {
+	where   string
+	expr    ast.ExprNode
+	columns []string                  // 条件中的列名, 小写
+	likes   map[string]*regexp.Regexp // LIKE的模式 -> 正则
+	warned  map[*TableMetadata]struct{}
+}
+
+func newRowFilter(where string) (*rowFilter, error) {
+	if strings.TrimSpace(where) == "" {
+		return nil, nil
+	}
+	stmts, _, err := parser.New().Parse("SELECT 1 FROM t WHERE "+where, "", "")
+	if err != nil {
+		return nil, errors.Annotatef(err, "where is illegal: %s", where)
+	}
+	sel, ok := stmts[0].(*ast.SelectStmt)
+	if len(stmts) != 1 || !ok || sel.Where == nil {
+		return nil, fmt.Errorf("where is illegal: %s", where)
+	}
+
+	f := &rowFilter{
+		where:  where,
+		expr:   sel.Where,
+		likes:  make(map[string]*regexp.Regexp),
+		warned: make(map[*TableMetadata]struct{}),
+	}
+	collector := &columnNameCollector{}
+	f.expr.Accept(collector)
+	f.columns = collector.names
+	// 不支持的表达式在这里报错, 之后求值不会失败
+	if _, err := f.eval(f.expr, nil); err != nil {
+		return nil, errors.Annotatef(err, "where: %s", where)
+	}
+	return f, nil
+}
+
+// 返回只包含满足条件的行的event, 所有行都满足时返回e本身, 都不满足时返回nil
+func (f *rowFilter) filter(tableMetadata *TableMetadata, e *replication.BinlogEvent) *replication.BinlogEvent {
+	kept, _ := f.split(tableMetadata, e)
+	return kept
+}
+
+// 按是否满足条件拆分event中的行. 一方包含全部的行时为e本身, 另一方为nil
+func (f *rowFilter) split(tableMetadata *TableMetadata, e *replication.BinlogEvent) (kept, dropped *replication.BinlogEvent) {
+	f.checkColumns(tableMetadata)
+	rowsEvent := e.Event.(*replication.RowsEvent)
+
+	step := 1
+	switch e.Header.EventType {
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		step = 2
+	}
+	var keptRows, droppedRows [][]interface{}
+	for i := 0; i+step <= len(rowsEvent.Rows); i += step {
+		matched := false
+		for j := i; j < i+step && !matched; j++ {
+			// 没有记录的列(binlog_row_image不为FULL)为NULL
+			row, _ := rowAt(rowsEvent, j)
+			matched = f.match(tableMetadata, row)
+		}
+		if matched {
+			keptRows = append(keptRows, rowsEvent.Rows[i:i+step]...)
+		} else {
+			droppedRows = append(droppedRows, rowsEvent.Rows[i:i+step]...)
+		}
+	}
+
+	switch len(keptRows) {
+	case 0:
+		return nil, e
+	case len(rowsEvent.Rows):
+		return e, nil
+	}
+	return withRows(e, keptRows), withRows(e, droppedRows)
+}
+
+// 复制e, 只包含rows
+func withRows(e *replication.BinlogEvent, rows [][]interface{}) *replication.BinlogEvent {
+	rowsEvent := *e.Event.(*replication.RowsEvent)
+	rowsEvent.Rows = rows
+	event := *e
+	event.Event = &rowsEvent
+	return &event
+}
+
+func (f *rowFilter) match(tableMetadata *TableMetadata, row []interface{}) bool {
+	values := make(map[string]interface{}, len(row))
+	for idx, value := range row {
+		if idx >= len(tableMetadata.Fields) {
+			break
+		}
+		values[strings.ToLower(tableMetadata.Fields[idx])] = columnWhereValue(value, tableMetadata.Columns[idx])
+	}
+	res, err := f.eval(f.expr, values)
+	if err != nil {
+		return false
+	}
+	ok, null := whereTruth(res)
+	return ok && !null
+}
+
+// 表中没有条件里的列时提示一次, 这些列按NULL处理
+func (f *rowFilter) checkColumns(tableMetadata *TableMetadata) {
+	if _, ok := f.warned[tableMetadata]; ok {
+		return
+	}
+	f.warned[tableMetadata] = struct{}{}
+
+	fields := make(map[string]struct{}, len(tableMetadata.Fields))
+	for _, field := range tableMetadata.Fields {
+		fields[strings.ToLower(field)] = struct{}{}
+	}
+	var missing []string
+	for _, column := range f.columns {
+		if _, ok := fields[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) != 0 {
+		log.Warnf("where: %s.%s has no column %s, treated as NULL", tableMetadata.Schema, tableMetadata.Table, strings.Join(missing, ", "))
+	}
+}
+
+// 求值的结果为nil(NULL), decimal.Decimal或string, 布尔值为1/0
+func (f *rowFilter) eval(expr ast.ExprNode, row map[string]interface{}) (interface{}, error) {
+	switch n := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return f.eval(n.Expr, row)
+	case *ast.ColumnNameExpr:
+		return row[n.Name.Name.L], nil
+	case ast.ValueExpr:
+		return literalWhereValue(n.GetValue()), nil
+	case *ast.UnaryOperationExpr:
+		v, err := f.eval(n.V, row)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case opcode.Not, opcode.Not2:
+			ok, null := whereTruth(v)
+			return whereBool(!ok, null), nil
+		case opcode.Minus:
+			if d, ok := whereNumber(v); ok {
+				return d.Neg(), nil
+			}
+			return v, nil
+		case opcode.Plus:
+			return v, nil
+		}
+		return nil, fmt.Errorf("unsupported operator: %s", n.Op)
+	case *ast.BinaryOperationExpr:
+		l, err := f.eval(n.L, row)
+		if err != nil {
+			return nil, err
+		}
+		r, err := f.eval(n.R, row)
+		if err != nil {
+			return nil, err
+		}
+		return evalBinary(n.Op, l, r)
+	case *ast.IsNullExpr:
+		v, err := f.eval(n.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		return whereBool((v == nil) != n.Not, false), nil
+	case *ast.IsTruthExpr:
+		v, err := f.eval(n.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		ok, null := whereTruth(v)
+		is := !null && ok == (n.True != 0)
+		return whereBool(is != n.Not, false), nil
+	case *ast.PatternInExpr:
+		if n.Sel != nil {
+			return nil, errors.New("subquery is not supported")
+		}
+		v, err := f.eval(n.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		// 有匹配为真, 否则有NULL时为NULL
+		found, null := false, v == nil
+		for _, item := range n.List {
+			iv, err := f.eval(item, row)
+			if err != nil {
+				return nil, err
+			}
+			if cmp, ok := whereCompare(v, iv); !ok {
+				null = true
+			} else if cmp == 0 {
+				found = true
+			}
+		}
+		if found {
+			return whereBool(!n.Not, false), nil
+		}
+		return whereBool(n.Not, null), nil
+	case *ast.BetweenExpr:
+		v, err := f.eval(n.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		left, err := f.eval(n.Left, row)
+		if err != nil {
+			return nil, err
+		}
+		right, err := f.eval(n.Right, row)
+		if err != nil {
+			return nil, err
+		}
+		ge, _ := evalBinary(opcode.GE, v, left)
+		le, _ := evalBinary(opcode.LE, v, right)
+		res, _ := evalBinary(opcode.LogicAnd, ge, le)
+		if n.Not {
+			ok, null := whereTruth(res)
+			return whereBool(!ok, null), nil
+		}
+		return res, nil
+	case *ast.PatternLikeExpr:
+		v, err := f.eval(n.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := f.eval(n.Pattern, row)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil || pattern == nil {
+			return nil, nil
+		}
+		re, err := f.likeRegexp(whereString(pattern), n.Escape)
+		if err != nil {
+			return nil, err
+		}
+		return whereBool(re.MatchString(whereString(v)) != n.Not, false), nil
+	}
+	return nil, fmt.Errorf("unsupported expression: %T", expr)
+}
+
+func evalBinary(op opcode.Op, l, r interface{}) (interface{}, error) {
+	switch op {
+	case opcode.LogicAnd:
+		lok, lnull := whereTruth(l)
+		rok, rnull := whereTruth(r)
+		if (!lok && !lnull) || (!rok && !rnull) {
+			return whereBool(false, false), nil
+		}
+		return whereBool(true, lnull || rnull), nil
+	case opcode.LogicOr:
+		lok, lnull := whereTruth(l)
+		rok, rnull := whereTruth(r)
+		if (lok && !lnull) || (rok && !rnull) {
+			return whereBool(true, false), nil
+		}
+		return whereBool(false, lnull || rnull), nil
+	case opcode.LogicXor:
+		lok, lnull := whereTruth(l)
+		rok, rnull := whereTruth(r)
+		return whereBool(lok != rok, lnull || rnull), nil
+	case opcode.NullEQ:
+		if l == nil || r == nil {
+			return whereBool(l == nil && r == nil, false), nil
+		}
+		cmp, _ := whereCompare(l, r)
+		return whereBool(cmp == 0, false), nil
+	case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE:
+		cmp, ok := whereCompare(l, r)
+		if !ok {
+			return nil, nil
+		}
+		switch op {
+		case opcode.EQ:
+			return whereBool(cmp == 0, false), nil
+		case opcode.NE:
+			return whereBool(cmp != 0, false), nil
+		case opcode.LT:
+			return whereBool(cmp < 0, false), nil
+		case opcode.LE:
+			return whereBool(cmp <= 0, false), nil
+		case opcode.GT:
+			return whereBool(cmp > 0, false), nil
+		default:
+			return whereBool(cmp >= 0, false), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operator: %s", op)
+}
+
+// LIKE的模式转换为正则: % 任意个字符, _ 一个字符, escape之后的字符为字面量
+func (f *rowFilter) likeRegexp(pattern string, escape byte) (*regexp.Regexp, error) {
+	key := string(escape) + pattern
+	if re, ok := f.likes[key]; ok {
+		return re, nil
+	}
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; {
+		case c == rune(escape) && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	f.likes[key] = re
+	return re, nil
+}
+
+// 有一边是数字且另一边能转换为数字时按数字比较, 否则按字符串比较. 有NULL时ok为false
+func whereCompare(l, r interface{}) (cmp int, ok bool) {
+	if l == nil || r == nil {
+		return 0, false
+	}
+	_, lIsNumber := l.(decimal.Decimal)
+	_, rIsNumber := r.(decimal.Decimal)
+	ld, lok := whereNumber(l)
+	rd, rok := whereNumber(r)
+	if (lIsNumber || rIsNumber) && lok && rok {
+		return ld.Cmp(rd), true
+	}
+	return strings.Compare(whereString(l), whereString(r)), true
+}
+
+func whereNumber(v interface{}) (decimal.Decimal, bool) {
+	switch v := v.(type) {
+	case decimal.Decimal:
+		return v, true
+	case string:
+		d, err := decimal.NewFromString(strings.TrimSpace(v))
+		return d, err == nil
+	}
+	return decimal.Decimal{}, false
+}
+
+func whereString(v interface{}) string {
+	if d, ok := v.(decimal.Decimal); ok {
+		return d.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// 同mysql, 非0的数字为真, 不是数字的字符串为假
+func whereTruth(v interface{}) (ok bool, null bool) {
+	if v == nil {
+		return false, true
+	}
+	d, isNumber := whereNumber(v)
+	return isNumber && !d.IsZero(), false
+}
+
+func whereBool(ok bool, null bool) interface{} {
+	switch {
+	case null:
+		return nil
+	case ok:
+		return decimal.NewFromInt(1)
+	default:
+		return decimal.Zero
+	}
+}
+
+// 列的值按json的规则转换(enum、set为字符串), 二进制列取原始的字节
+func columnWhereValue(value interface{}, column *Column) interface{} {
+	if value == nil {
+		return nil
+	}
+	if column != nil && column.IsBinary() {
+		return string(toBytes(value))
+	}
+	switch v := buildJSONFieldValue(value, column).(type) {
+	case json.Number:
+		if d, err := decimal.NewFromString(v.String()); err == nil {
+			return d
+		}
+		return v.String()
+	case json.RawMessage:
+		return string(v)
+	default:
+		return literalWhereValue(v)
+	}
+}
+
+func literalWhereValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case decimal.Decimal:
+		return v
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case test_driver.BinaryLiteral:
+		return v.ToString()
+	case *test_driver.MyDecimal:
+		if d, err := decimal.NewFromString(v.String()); err == nil {
+			return d
+		}
+		return v.String()
+	case float32:
+		return decimal.NewFromFloat32(v)
+	case float64:
+		return decimal.NewFromFloat(v)
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		if d, err := decimal.NewFromString(fmt.Sprintf("%d", v)); err == nil {
+			return d
+		}
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// 收集表达式中的列名
+type columnNameCollector struct {
+	names []string
+}
+
+func (c *columnNameCollector) Enter(n ast.Node) (ast.Node, bool) {
+	if column, ok := n.(*ast.ColumnNameExpr); ok {
+		for _, name := range c.names {
+			if name == column.Name.Name.L {
+				return n, false
+			}
+		}
+		c.names = append(c.names, column.Name.Name.L)
+	}
+	return n, false
+}
+
+func (c *columnNameCollector) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
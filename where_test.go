@@ -0,0 +1,106 @@
+package mysql_flashback
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// id int unsigned, Name varchar, status enum, amount decimal, data varbinary
+var testWhereMetadata = &TableMetadata{
+	Schema: "shop",
+	Table:  "t",
+	Fields: map[int]string{0: "id", 1: "Name", 2: "status", 3: "amount", 4: "data"},
+	Columns: map[int]*Column{
+		0: {Name: "id", DataType: "int", Unsigned: true},
+		1: {Name: "Name", DataType: "varchar", Nullable: true},
+		2: {Name: "status", DataType: "enum", Elements: []string{"new", "paid"}},
+		3: {Name: "amount", DataType: "decimal", Nullable: true},
+		4: {Name: "data", DataType: "varbinary", Nullable: true},
+	},
+}
+
+func testRowFilterMatch(t *testing.T, row []interface{}, where string, want bool) {
+	t.Helper()
+	f, err := newRowFilter(where)
+	if err != nil {
+		t.Fatalf("newRowFilter(%q) error = %v", where, err)
+	}
+	if got := f.match(testWhereMetadata, row); got != want {
+		t.Errorf("%q on %v = %v, want %v", where, row, got, want)
+	}
+}
+
+func TestRowFilterMatch(t *testing.T) {
+	row := []interface{}{int32(-1), "Alice", int64(2), decimal.RequireFromString("12.50"), []byte("ab")}
+	for _, where := range []string{
+		"id = 4294967295", // unsigned还原后比较
+		"id > 100 AND name = 'Alice'",
+		"status = 'paid'",
+		"status NOT IN ('new')",
+		"amount = 12.5",
+		"amount BETWEEN 10 AND 12.5",
+		"name LIKE 'Al%'",
+		"data = 'ab'",
+		"id = 1 OR status = 'paid'",
+		"id = 1 XOR status = 'paid'",
+		"-amount < 0",
+		"missing IS NULL", // 表中没有的列为NULL
+	} {
+		testRowFilterMatch(t, row, where, true)
+	}
+	for _, where := range []string{
+		"NAME = 'alice'", // 列名不区分大小写, 值区分
+		"status IN ('new', 'x')",
+		"amount NOT BETWEEN 10 AND 12.5",
+		"name LIKE 'al%'",
+		"name NOT LIKE '_lice'",
+		"NOT (status = 'paid')",
+		"missing = 1",
+	} {
+		testRowFilterMatch(t, row, where, false)
+	}
+}
+
+// NULL参与的比较结果为NULL, 不满足条件, NOT NULL仍为NULL
+func TestRowFilterMatchNull(t *testing.T) {
+	row := []interface{}{int32(7), nil, int64(1), nil, nil}
+	for _, where := range []string{
+		"name IS NULL",
+		"name <=> NULL",
+		"name = 'x' OR id = 7",
+		"(id = 7) IS TRUE",
+		"(name = 'x') IS NOT TRUE",
+	} {
+		testRowFilterMatch(t, row, where, true)
+	}
+	for _, where := range []string{
+		"name = 'Alice'",
+		"name != 'Alice'",
+		"amount IS NOT NULL",
+		"name IN ('a', NULL)",
+		"NOT (name IN ('a', NULL))",
+	} {
+		testRowFilterMatch(t, row, where, false)
+	}
+}
+
+func TestNewRowFilter(t *testing.T) {
+	for _, where := range []string{"", "  "} {
+		if f, err := newRowFilter(where); f != nil || err != nil {
+			t.Errorf("newRowFilter(%q) = %v, %v, want nil", where, f, err)
+		}
+	}
+	// 不支持的表达式在创建时报错
+	for _, where := range []string{
+		"id =",
+		"id IN (SELECT id FROM u)",
+		"id = 1; DROP TABLE t",
+		"id + 1 = 2",
+		"CONCAT(name, 'a') = 'b'",
+	} {
+		if _, err := newRowFilter(where); err == nil {
+			t.Errorf("newRowFilter(%q) error = nil, want error", where)
+		}
+	}
+}